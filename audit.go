@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const serviceAccountFile = "serviceAccountKey.json"
+
+// finishTimeout is how long writing the final run record may take, also
+// after the run itself was canceled.
+const finishTimeout = time.Minute
+
+// errInterrupted is returned for writes that weren't started because the
+// upload was interrupted.
+var errInterrupted = errors.New("upload interrupted")
+
+// uploadCounts are the documents one run touched in one collection.
+type uploadCounts struct {
+	created int
+	updated int
+	deleted int
+	errors  int
+	retries int
+}
+
+// uploadRun is the audit record of one upload, stored as uploads/{runID}.
+// Its counts are updated by the write workers, so they are guarded by mu.
+type uploadRun struct {
+	mu sync.Mutex
+
+	id             string
+	serviceAccount string
+	machineUser    string
+	requestedBy    string
+	profile        string
+	hostname       string
+	workbook       string
+	workbookSHA256 string
+	rtdbURL        string
+	rtdbPath       string
+	startedAt      time.Time
+	finishedAt     time.Time
+	projects       []string
+	counts         map[string]*uploadCounts
+	err            string
+	interrupted    bool
+
+	// projectWrites are the documents written below each project, by
+	// collection, for the notifications.
+	projectWrites map[string]map[string]int
+}
+
+func newUploadRun(workbook string) (*uploadRun, error) {
+	id, err := newRunID(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	run := &uploadRun{
+		id:             id,
+		serviceAccount: serviceAccountEmail(target.Credentials),
+		profile:        target.name,
+		workbook:       filepath.Base(workbook),
+		startedAt:      time.Now(),
+		counts:         make(map[string]*uploadCounts),
+		projectWrites:  make(map[string]map[string]int),
+	}
+	if u, err := user.Current(); err == nil {
+		run.machineUser = u.Username
+	}
+	run.hostname, _ = os.Hostname()
+	if run.workbookSHA256, err = sourceSHA256(workbook); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// newRunID makes IDs that sort by start time and don't collide when two
+// people upload in the same second.
+func newRunID(t time.Time) (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return t.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b), nil
+}
+
+// sourceSHA256 is the hash of a source file, or of the names and contents of
+// the files of a source directory.
+func sourceSHA256(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return fileSHA256(path)
+	}
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		sum, err := fileSHA256(filepath.Join(path, f.Name()))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %s\n", sum, f.Name())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// uploadedRun returns the ID of a finished upload run of a source with the
+// given hash, or "" when it was never uploaded completely. Runs that were
+// rolled back don't count; queries can't ask for a missing field, so they are
+// skipped here.
+func uploadedRun(ctx context.Context, client *firestore.Client, sum string) (id string, err error) {
+	query := client.Collection(collection(uploadsCollection)).Where("workbook_sha256", "==", sum).
+		Where("status", "==", "done")
+	err = eachSnapshot(query.Documents(ctx), func(snap *firestore.DocumentSnapshot) error {
+		if _, ok := snap.Data()["rolled_back_at"]; !ok && id == "" {
+			id = snap.Ref.ID
+		}
+		return nil
+	})
+	return id, err
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// serviceAccountKey are the fields of a service account key file the
+// program uses.
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	ProjectID   string `json:"project_id"`
+}
+
+// readServiceAccountKey reads a service account key file, the fields are
+// empty when it can't be read.
+func readServiceAccountKey(path string) serviceAccountKey {
+	var key serviceAccountKey
+	if data, err := ioutil.ReadFile(path); err == nil {
+		json.Unmarshal(data, &key)
+	}
+	return key
+}
+
+// serviceAccountEmail returns the client_email of a service account key file,
+// or an empty string when it can't be read.
+func serviceAccountEmail(path string) string {
+	return readServiceAccountKey(path).ClientEmail
+}
+
+// record updates the counts of a collection, e.g.
+// run.record("users", func(c *uploadCounts) { c.created++ }).
+func (r *uploadRun) record(collection string, update func(c *uploadCounts)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.counts[collection]
+	if !ok {
+		c = &uploadCounts{}
+		r.counts[collection] = c
+	}
+	update(c)
+}
+
+// recordWrite counts a document written below a project.
+func (r *uploadRun) recordWrite(projectID, collection string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w, ok := r.projectWrites[projectID]
+	if !ok {
+		w = make(map[string]int)
+		r.projectWrites[projectID] = w
+	}
+	w[collection]++
+}
+
+func (r *uploadRun) addProject(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range r.projects {
+		if p == id {
+			return
+		}
+	}
+	r.projects = append(r.projects, id)
+}
+
+func (r *uploadRun) toFirestore() map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := make(map[string]interface{}, len(r.counts))
+	for coll, c := range r.counts {
+		counts[coll] = map[string]interface{}{
+			"created": c.created,
+			"updated": c.updated,
+			"deleted": c.deleted,
+			"errors":  c.errors,
+			"retries": c.retries,
+		}
+	}
+	state := "running"
+	var finishedAt interface{}
+	if !r.finishedAt.IsZero() {
+		state, finishedAt = "done", r.finishedAt
+		if r.interrupted {
+			state = "interrupted"
+		} else if r.err != "" {
+			state = "failed"
+		}
+	}
+	return map[string]interface{}{
+		"run_id":          r.id,
+		"service_account": r.serviceAccount,
+		"machine_user":    r.machineUser,
+		"requested_by":    r.requestedBy,
+		"profile":         r.profile,
+		"hostname":        r.hostname,
+		"workbook":        r.workbook,
+		"workbook_sha256": r.workbookSHA256,
+		"rtdb_url":        r.rtdbURL,
+		"rtdb_path":       r.rtdbPath,
+		"started_at":      r.startedAt,
+		"finished_at":     finishedAt,
+		"status":          state,
+		"error":           r.err,
+		"projects":        r.projects,
+		"counts":          counts,
+	}
+}
+
+// written is the number of documents created or updated below a project,
+// per collection.
+func (r *uploadRun) written(projectID string) map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	written := make(map[string]int, len(r.projectWrites[projectID]))
+	for coll, n := range r.projectWrites[projectID] {
+		written[coll] = n
+	}
+	return written
+}
+
+// summary is the per-collection counts for the console.
+func (r *uploadRun) summary() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	colls := make([]string, 0, len(r.counts))
+	for coll := range r.counts {
+		colls = append(colls, coll)
+	}
+	sort.Strings(colls)
+	s := fmt.Sprintf("Upload run %s:", r.id)
+	for _, coll := range colls {
+		c := r.counts[coll]
+		s += fmt.Sprintf("\n  %-18s %4d created %4d updated %4d deleted %4d errors %4d retries",
+			coll, c.created, c.updated, c.deleted, c.errors, c.retries)
+	}
+	return s
+}
+
+// uploadOptions are the settings of an upload run given on the command line.
+type uploadOptions struct {
+	// history keeps the prior state of changed documents, see
+	// historyCollections.
+	history bool
+	// workers is the number of documents written at the same time by queue.
+	workers int
+	// rate limits the document writes per second, 0 is unlimited.
+	rate float64
+	// attempts is how often a call that fails with a transient error is
+	// tried, retryBudget how many retries the whole run may spend and
+	// retryWait the backoff before the first retry.
+	attempts    int
+	retryBudget int
+	retryWait   time.Duration
+	// rpcTimeout limits every single Firestore or Auth call, 0 is no limit.
+	rpcTimeout time.Duration
+	// mirror also writes the project tree to the Realtime Database, nil
+	// when it isn't mirrored.
+	mirror *rtdbMirror
+}
+
+// uploader writes the documents of one upload run and keeps its audit
+// record up to date. set writes a document right away, queue hands it to
+// the write workers.
+type uploader struct {
+	ctx     context.Context
+	client  *firestore.Client
+	run     *uploadRun
+	log     *logger
+	opts    uploadOptions
+	limiter *rateLimiter
+	retries *retryPolicy
+	pool    *writePool
+
+	mu sync.Mutex
+	// changes maps the path of every written document to its record in the
+	// changes subcollection of the run.
+	changes map[string]string
+}
+
+func newUploader(ctx context.Context, client *firestore.Client, run *uploadRun, opts uploadOptions) (*uploader, error) {
+	u := &uploader{ctx: ctx, client: client, run: run, opts: opts, changes: make(map[string]string),
+		log: applog.with("run", run.id), limiter: newRateLimiter(opts.rate),
+		retries: newRetryPolicy(opts.attempts, opts.retryBudget, opts.retryWait, opts.rpcTimeout)}
+	err := u.retry("uploads", func(ctx context.Context) error {
+		_, err := u.runRef().Set(ctx, run.toFirestore())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	u.pool = newWritePool(u, opts.workers)
+	return u, nil
+}
+
+func (u *uploader) runRef() *firestore.DocumentRef {
+	return u.client.Collection(collection(uploadsCollection)).Doc(u.run.id)
+}
+
+// set writes a document and counts it as created or updated in the
+// collection it belongs to. In history mode the prior state is saved first.
+// Every write is recorded with the run so it can be rolled back.
+func (u *uploader) set(ref *firestore.DocumentRef, data map[string]interface{}, opts ...firestore.SetOption) error {
+	if isInterrupted() {
+		return errInterrupted
+	}
+	coll := ref.Parent.ID
+	if ref.Parent.Parent == nil {
+		// Top-level collections are counted without the profile's prefix.
+		coll = strings.TrimPrefix(coll, target.CollectionPrefix)
+	}
+	u.limiter.wait()
+	var snap *firestore.DocumentSnapshot
+	err := u.retry(coll, func(ctx context.Context) (err error) {
+		snap, err = ref.Get(ctx)
+		return err
+	})
+	exists := err == nil
+	if err != nil && status.Code(err) != codes.NotFound {
+		u.run.record(coll, func(c *uploadCounts) { c.errors++ })
+		return err
+	}
+	if exists && u.opts.history && historyCollections[coll] {
+		var hwr *firestore.WriteResult
+		err = u.retry(historyCollection, func(ctx context.Context) (err error) {
+			hwr, err = saveHistory(ctx, snap, u.run.id)
+			return err
+		})
+		if err != nil {
+			u.run.record(historyCollection, func(c *uploadCounts) { c.errors++ })
+			return err
+		}
+		// The version is a document the run created, so a rollback removes
+		// it along with the change it belongs to.
+		href := ref.Collection(historyCollection).Doc(u.run.id)
+		if err = u.recordChange(href, nil, hwr.UpdateTime); err != nil {
+			return fmt.Errorf("recording change of %s: %v", relativePath(href), err)
+		}
+		u.run.record(historyCollection, func(c *uploadCounts) { c.created++ })
+	}
+	var wr *firestore.WriteResult
+	err = u.retry(coll, func(ctx context.Context) (err error) {
+		wr, err = ref.Set(ctx, data, opts...)
+		return err
+	})
+	if err != nil {
+		u.run.record(coll, func(c *uploadCounts) { c.errors++ })
+		return err
+	}
+	if !exists {
+		snap = nil
+	}
+	if err = u.recordChange(ref, snap, wr.UpdateTime); err != nil {
+		return fmt.Errorf("recording change of %s: %v", relativePath(ref), err)
+	}
+	if path := relativePath(ref); u.opts.mirror != nil && mirrored(path) {
+		// The only SetOption the upload uses is MergeAll.
+		err = u.retry(mirrorCollection, func(ctx context.Context) error {
+			return u.opts.mirror.set(ctx, path, data, len(opts) != 0)
+		})
+		if err != nil {
+			u.run.record(mirrorCollection, func(c *uploadCounts) { c.errors++ })
+			return fmt.Errorf("mirroring %s to the Realtime Database: %v", path, err)
+		}
+		u.run.record(mirrorCollection, func(c *uploadCounts) { c.updated++ })
+	}
+	if id := projectOf(ref); id != "" {
+		u.run.recordWrite(id, coll)
+	}
+	if exists {
+		u.run.record(coll, func(c *uploadCounts) { c.updated++ })
+		u.log.debug("Updated document", "path", relativePath(ref))
+	} else {
+		u.run.record(coll, func(c *uploadCounts) { c.created++ })
+		u.log.debug("Created document", "path", relativePath(ref))
+	}
+	return nil
+}
+
+// projectOf returns the ID of the project a document is, or is below, and ""
+// for documents outside of the project collection.
+func projectOf(ref *firestore.DocumentRef) string {
+	for ref.Parent.Parent != nil {
+		ref = ref.Parent.Parent
+	}
+	if ref.Parent.ID != collection(projectCollection) {
+		return ""
+	}
+	return ref.ID
+}
+
+// finish completes the audit record. A failed run keeps its error message.
+// Queued writes must be flushed before.
+func (u *uploader) finish(runErr string) error {
+	u.pool.close()
+	u.run.finishedAt = time.Now()
+	u.run.err = runErr
+	// The record is written even when the run was canceled.
+	ctx, cancel := context.WithTimeout(context.Background(), finishTimeout)
+	defer cancel()
+	return u.retryWith(ctx, "uploads", func(ctx context.Context) error {
+		_, err := u.runRef().Set(ctx, u.run.toFirestore())
+		return err
+	})
+}
+
+// fail records the error in the audit record before the program stops. The
+// fields give the context of the error, as with logger. Queued writes that
+// haven't started are dropped, the running ones are waited for.
+func (u *uploader) fail(msg string, kv ...interface{}) {
+	u.pool.abort()
+	if isInterrupted() {
+		u.interrupt()
+	}
+	runErr := msg
+	for i := 0; i+1 < len(kv); i += 2 {
+		if kv[i] == "err" {
+			runErr += fmt.Sprintf(": %v", kv[i+1])
+		}
+	}
+	if err := u.finish(runErr); err != nil {
+		u.log.error("Can't update the upload run record", "err", err)
+	}
+	u.log.fatal(msg, kv...)
+}
+
+// interrupt ends an interrupted upload: the writes in flight are waited for,
+// the run is recorded as interrupted with the counts of what was written and
+// the program stops with exitInterrupted. The run can be rolled back like
+// any other.
+func (u *uploader) interrupt() {
+	u.pool.abort()
+	u.run.interrupted = true
+	if err := u.finish(""); err != nil {
+		u.log.error("Can't update the upload run record", "err", err)
+	}
+	u.log.warn("Upload interrupted, the documents written so far are recorded with the run")
+	fmt.Println(u.run.summary())
+	u.log.info("Undo the partial upload with: firestoreUpload rollback " + u.run.id)
+	exit(exitInterrupted)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// cableEnd is one stressing end of a cable as read from a Manipulate sheet row.
+type cableEnd struct {
+	endID       string
+	suffix      string
+	secondEnd   bool
+	elongation  float64
+	designation string
+}
+
+// cable groups the rows of a single cable. Single-ended cables have one end,
+// double-stressed cables have a first and a second end.
+type cable struct {
+	id          string
+	designation string
+	isDouble    bool
+	ends        []cableEnd
+}
+
+// elongation returns the combined elongation measured across all ends.
+func (c cable) elongation() float64 {
+	var total float64
+	for _, e := range c.ends {
+		total += e.elongation
+	}
+	return total
+}
+
+func (c cable) toFirestore() map[string]interface{} {
+	ends := make([]interface{}, 0, len(c.ends))
+	for _, e := range c.ends {
+		ends = append(ends, map[string]interface{}{
+			"end_id":        e.endID,
+			"suffix":        e.suffix,
+			"is_second_end": e.secondEnd,
+			"elongation":    e.elongation,
+		})
+	}
+	return map[string]interface{}{
+		"designation": c.designation,
+		"is_double":   c.isDouble,
+		"cable_id":    c.id,
+		"ends":        ends,
+		"elongation":  c.elongation(),
+	}
+}
+
+// groupCables pairs the first and second end rows of every cable. Rows without
+// a cable_id can't be paired and are kept as single-ended cables.
+func groupCables(lines []map[string]string) (cables []cable, issues []validationIssue) {
+	index := make(map[string]int)
+	for _, line := range lines {
+		isDouble, _ := strconv.ParseBool(line["is_double"])
+		cableorder, _ := strconv.Atoi(line["is_second_end"])
+		elongation, _ := strconv.ParseFloat(line["elongation"], 64)
+		end := cableEnd{
+			endID:       line["end_id"],
+			suffix:      line["suffix"],
+			secondEnd:   cableorder == 1,
+			elongation:  elongation,
+			designation: designationName(line["Set Designation"]),
+		}
+
+		id := line["cable_id"]
+		i, seen := index[id]
+		if id == "" || !seen {
+			if id != "" {
+				index[id] = len(cables)
+			}
+			cables = append(cables, cable{
+				id:          id,
+				designation: end.designation,
+				isDouble:    isDouble,
+				ends:        []cableEnd{end},
+			})
+			continue
+		}
+
+		c := &cables[i]
+		if isDouble != c.isDouble {
+			issues = append(issues, validationIssue{sheet: "Manipulate", row: rowOf(line), key: id,
+				msg: "rows disagree on is_double"})
+		}
+		if end.designation != c.designation {
+			issues = append(issues, validationIssue{sheet: "Manipulate", row: rowOf(line), key: id,
+				msg: fmt.Sprintf("ends have different designations %q and %q", c.designation, end.designation)})
+		}
+		c.ends = append(c.ends, end)
+	}
+
+	for i := range cables {
+		c := &cables[i]
+		first, second := 0, 0
+		for _, e := range c.ends {
+			if e.secondEnd {
+				second++
+			} else {
+				first++
+			}
+		}
+		switch {
+		case c.isDouble && (first != 1 || second != 1):
+			issues = append(issues, validationIssue{sheet: "Manipulate", key: c.id,
+				msg: fmt.Sprintf("double cable needs exactly one first and one second end, got %d first and %d second", first, second)})
+		case !c.isDouble && (first != 1 || second != 0):
+			issues = append(issues, validationIssue{sheet: "Manipulate", key: c.id,
+				msg: fmt.Sprintf("single cable needs exactly one first end row, got %d first and %d second", first, second)})
+		}
+		// Keep the first end in front so ends[0] is always the live end.
+		if len(c.ends) == 2 && c.ends[0].secondEnd && !c.ends[1].secondEnd {
+			c.ends[0], c.ends[1] = c.ends[1], c.ends[0]
+		}
+	}
+
+	return cables, issues
+}
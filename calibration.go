@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tealeg/xlsx"
+)
+
+const calibrationSheetName = "Calibration"
+
+type calibrationPoint struct {
+	pressure float64
+	force    float64
+}
+
+// calibrationCurve is the certificate of one ram used with one gauge: gauge
+// pressure in psi against the actual force in kips, ordered by pressure.
+type calibrationCurve struct {
+	ram    string
+	gauge  string
+	points []calibrationPoint
+}
+
+func calibrationKey(ram, gauge string) string {
+	return ram + "-" + gauge
+}
+
+// force converts a gauge pressure to the actual jack force by linear
+// interpolation between the two nearest certificate points.
+func (c calibrationCurve) force(pressure float64) (float64, error) {
+	if len(c.points) < 2 {
+		return 0, fmt.Errorf("calibration %s needs at least two points", calibrationKey(c.ram, c.gauge))
+	}
+	first, last := c.points[0], c.points[len(c.points)-1]
+	if pressure < first.pressure || pressure > last.pressure {
+		return 0, fmt.Errorf("pressure %v psi is outside of calibration %s range %v..%v psi",
+			pressure, calibrationKey(c.ram, c.gauge), first.pressure, last.pressure)
+	}
+	i := sort.Search(len(c.points), func(i int) bool { return c.points[i].pressure >= pressure })
+	if c.points[i].pressure == pressure {
+		return c.points[i].force, nil
+	}
+	lo, hi := c.points[i-1], c.points[i]
+	return lo.force + (pressure-lo.pressure)*(hi.force-lo.force)/(hi.pressure-lo.pressure), nil
+}
+
+func (c calibrationCurve) toFirestore() map[string]interface{} {
+	points := make([]interface{}, 0, len(c.points))
+	for _, p := range c.points {
+		points = append(points, map[string]interface{}{
+			"pressure": p.pressure,
+			"force":    p.force,
+		})
+	}
+	return map[string]interface{}{
+		"ram":    c.ram,
+		"gauge":  c.gauge,
+		"points": points,
+	}
+}
+
+// readCalibrations reads the calibration table from the Calibration sheet of
+// filename. A workbook with a single sheet is taken as a calibration file on
+// its own. Missing tables are not an error since calibration is optional.
+func readCalibrations(filename string) ([]map[string]string, error) {
+	xlFile, err := xlsx.OpenFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	sheet, ok := xlFile.Sheet[calibrationSheetName]
+	if !ok && len(xlFile.Sheets) == 1 {
+		sheet, ok = xlFile.Sheets[0], true
+	}
+	if !ok {
+		return nil, nil
+	}
+	return readSheetToSliceOfMap(sheet)
+}
+
+// buildCalibrations groups the calibration rows into one curve per ram/gauge
+// pair, keyed by calibrationKey.
+func buildCalibrations(lines []map[string]string) (curves map[string]*calibrationCurve, order []string, issues []validationIssue) {
+	curves = make(map[string]*calibrationCurve)
+	for _, line := range lines {
+		key := calibrationKey(line["ram"], line["gauge"])
+		if line["ram"] == "" || line["gauge"] == "" {
+			issues = append(issues, validationIssue{sheet: calibrationSheetName, row: rowOf(line), key: key,
+				msg: "ram and gauge are required"})
+			continue
+		}
+		pressure, perr := strconv.ParseFloat(line["pressure"], 64)
+		force, ferr := strconv.ParseFloat(line["force"], 64)
+		if perr != nil || ferr != nil {
+			issues = append(issues, validationIssue{sheet: calibrationSheetName, row: rowOf(line), key: key,
+				msg: fmt.Sprintf("pressure %q and force %q must be numbers", line["pressure"], line["force"])})
+			continue
+		}
+		c, ok := curves[key]
+		if !ok {
+			c = &calibrationCurve{ram: line["ram"], gauge: line["gauge"]}
+			curves[key] = c
+			order = append(order, key)
+		}
+		c.points = append(c.points, calibrationPoint{pressure, force})
+	}
+
+	for _, key := range order {
+		c := curves[key]
+		sort.Slice(c.points, func(i, j int) bool { return c.points[i].pressure < c.points[j].pressure })
+		if len(c.points) < 2 {
+			issues = append(issues, validationIssue{sheet: calibrationSheetName, key: key,
+				msg: "calibration needs at least two points"})
+			continue
+		}
+		for i := 1; i < len(c.points); i++ {
+			if c.points[i].pressure == c.points[i-1].pressure {
+				issues = append(issues, validationIssue{sheet: calibrationSheetName, key: key,
+					msg: fmt.Sprintf("duplicate pressure %v psi", c.points[i].pressure)})
+			} else if c.points[i].force < c.points[i-1].force {
+				issues = append(issues, validationIssue{sheet: calibrationSheetName, key: key,
+					msg: fmt.Sprintf("force decreases at %v psi", c.points[i].pressure)})
+			}
+		}
+	}
+	return curves, order, issues
+}
+
+var errNoCalibration = errors.New("no calibration for ram and gauge")
+
+// calibrationForce converts the project's calibration_psi to a force with the
+// curve of the project's ram and gauge.
+func calibrationForce(line map[string]string, curves map[string]*calibrationCurve) (float64, error) {
+	c, ok := curves[calibrationKey(line["ram"], line["gauge"])]
+	if !ok {
+		return 0, errNoCalibration
+	}
+	pressure, err := strconv.ParseFloat(line["calibration_psi"], 64)
+	if err != nil {
+		return 0, fmt.Errorf("calibration_psi %q is not a number", line["calibration_psi"])
+	}
+	return c.force(pressure)
+}
+
+// checkCalibrations validates the calibration data used by every project:
+// the calibration_psi must convert with the ram/gauge curve, and a
+// calibration_date older than certPeriod only gives a warning.
+func checkCalibrations(projectlines []map[string]string, curves map[string]*calibrationCurve, certPeriod time.Duration, now time.Time) (issues []validationIssue) {
+	for _, line := range projectlines {
+		if line["project_id"] == "" {
+			continue
+		}
+		if len(curves) != 0 && line["calibration_psi"] != "" {
+			if _, err := calibrationForce(line, curves); err != nil && err != errNoCalibration {
+				issues = append(issues, validationIssue{sheet: "Project", row: rowOf(line), key: line["project_id"], msg: err.Error()})
+			}
+		}
+		if line["calibration_date"] == "" || certPeriod <= 0 {
+			continue
+		}
+		calibrated, err := time.Parse("01-02-06", line["calibration_date"])
+		if err != nil {
+			issues = append(issues, validationIssue{sheet: "Project", row: rowOf(line), key: line["project_id"],
+				msg: fmt.Sprintf("calibration_date %q is not a date", line["calibration_date"])})
+			continue
+		}
+		if now.Sub(calibrated) > certPeriod {
+			issues = append(issues, validationIssue{sheet: "Project", row: rowOf(line), key: line["project_id"], warning: true,
+				msg: fmt.Sprintf("ram %s was calibrated on %s, more than %d days ago",
+					line["ram"], calibrated.Format("2006-01-02"), int(certPeriod.Hours()/24))})
+		}
+	}
+	return issues
+}
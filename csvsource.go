@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The files of a CSV source directory, one per sheet. project.csv and
+// manipulate.csv are required, the others may be left out.
+const (
+	csvUsers       = "users.csv"
+	csvProject     = "project.csv"
+	csvContacts    = "contacts.csv"
+	csvManipulate  = "manipulate.csv"
+	csvCalibration = "calibration.csv"
+)
+
+// csvDirReader reads a directory with one CSV file per sheet of the upload
+// workbook, with the same header names.
+type csvDirReader struct {
+	opts readerOptions
+}
+
+func (r csvDirReader) read(dir string) (*sourceSheets, error) {
+	s := &sourceSheets{}
+	var manipulate []map[string]string
+	for _, f := range []struct {
+		name     string
+		lines    *[]map[string]string
+		required bool
+	}{
+		{csvUsers, &s.users, false},
+		{csvProject, &s.project, true},
+		{csvContacts, &s.contacts, false},
+		{csvManipulate, &manipulate, true},
+		{csvCalibration, &s.calibration, false},
+	} {
+		path := filepath.Join(dir, f.name)
+		if !fileExists(path) {
+			if f.required {
+				return nil, fmt.Errorf("the source directory %q has no %s", dir, f.name)
+			}
+			continue
+		}
+		lines, err := readCSVFile(path, r.opts)
+		if err != nil {
+			return nil, err
+		}
+		*f.lines = lines
+	}
+	s.setManipulate(manipulate)
+	return s, nil
+}
+
+// readCSVFile reads a CSV file with a header row into one map per row, like
+// readSheetToSliceOfMap. Empty rows are skipped.
+func readCSVFile(path string, opts readerOptions) (res []map[string]string, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	text, err := decodeText(data, opts.encoding)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	r := csv.NewReader(strings.NewReader(text))
+	if opts.delimiter != 0 {
+		r.Comma = opts.delimiter
+	}
+	r.FieldsPerRecord = -1
+	var headers []string
+	for row := 1; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if headers == nil {
+			for i := range record {
+				record[i] = strings.TrimSpace(record[i])
+			}
+			headers = record
+			continue
+		}
+		if len(record) > len(headers) {
+			return nil, fmt.Errorf("%s: row %d has %d fields but the header only %d", path, row, len(record), len(headers))
+		}
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+		vals := make(map[string]string, len(record)+1)
+		for i, v := range record {
+			vals[headers[i]] = v
+		}
+		vals[rowKey] = strconv.Itoa(row)
+		res = append(res, vals)
+	}
+	return res, nil
+}
+
+// decodeText turns a text file into a string. A UTF-8 byte order mark, as
+// Excel writes it, is dropped whatever the encoding, since it can't be the
+// start of a header in any of them.
+func decodeText(data []byte, encoding string) (string, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	switch strings.ToLower(strings.Replace(encoding, "_", "-", -1)) {
+	case "", "utf-8", "utf8":
+		if !utf8.Valid(data) {
+			return "", fmt.Errorf("the file is not valid UTF-8, try -encoding windows-1252")
+		}
+		return string(data), nil
+	case "windows-1252", "cp1252":
+		return decodeWindows1252(data), nil
+	default:
+		return "", fmt.Errorf("unknown encoding %q, use utf-8 or windows-1252", encoding)
+	}
+}
+
+// windows1252 are the characters of the bytes 0x80 to 0x9F in Windows-1252.
+// The other bytes are the Unicode code point of the same value. The five
+// unassigned bytes map to the C1 control of the same value, like browsers do.
+var windows1252 = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', '\u008D', 'Ž', '\u008F',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', '\u009D', 'ž', 'Ÿ',
+}
+
+func decodeWindows1252(data []byte) string {
+	var b strings.Builder
+	b.Grow(len(data))
+	for _, c := range data {
+		if c >= 0x80 && c < 0xA0 {
+			b.WriteRune(windows1252[c-0x80])
+		} else {
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.String()
+}
+
+// parseDelimiter accepts a single character, or "tab" for tab-separated
+// files.
+func parseDelimiter(v string) (rune, error) {
+	switch strings.ToLower(v) {
+	case "tab", `\t`:
+		return '\t', nil
+	}
+	r, size := utf8.DecodeRuneInString(v)
+	if size == 0 || size != len(v) || r == '"' || r == '\r' || r == '\n' {
+		return 0, fmt.Errorf("the delimiter must be a single character other than a quote or newline, got %q", v)
+	}
+	return r, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// designation is one distinct Set Designation of the Manipulate sheet with its
+// tolerances. Every row that uses the designation must agree on them.
+type designation struct {
+	name         string
+	toleranceMax float64
+	toleranceMin float64
+}
+
+// designationName normalizes a Set Designation value the same way it is
+// stored, so "12.5" and "12.50" are the same designation.
+func designationName(value string) string {
+	return fmt.Sprint(roundSpecial(strings.TrimSpace(value)))
+}
+
+// buildDesignations collects the distinct designations in sheet order and
+// reports rows that redefine a designation with different tolerances.
+func buildDesignations(lines []map[string]string) (res []designation, issues []validationIssue) {
+	index := make(map[string]int)
+	for _, line := range lines {
+		name := designationName(line["Set Designation"])
+		if name == "" {
+			continue
+		}
+		toleranceMax, errMax := strconv.ParseFloat(line["tolerance_max"], 64)
+		toleranceMin, errMin := strconv.ParseFloat(line["tolerance_min"], 64)
+		if (errMax != nil && line["tolerance_max"] != "") || (errMin != nil && line["tolerance_min"] != "") {
+			issues = append(issues, validationIssue{sheet: "Manipulate", row: rowOf(line), key: name,
+				msg: fmt.Sprintf("tolerance_min %q and tolerance_max %q must be numbers", line["tolerance_min"], line["tolerance_max"])})
+			continue
+		}
+		d := designation{name, toleranceMax, toleranceMin}
+
+		i, seen := index[name]
+		if !seen {
+			index[name] = len(res)
+			res = append(res, d)
+			continue
+		}
+		if res[i] != d {
+			issues = append(issues, validationIssue{sheet: "Manipulate", row: rowOf(line), key: name,
+				msg: fmt.Sprintf("conflicting tolerances: min %v max %v and min %v max %v",
+					res[i].toleranceMin, res[i].toleranceMax, d.toleranceMin, d.toleranceMax)})
+		}
+	}
+	return res, issues
+}
+
+func (d designation) toFirestore() map[string]interface{} {
+	return map[string]interface{}{
+		"name":          d.name,
+		"tolerance_max": d.toleranceMax,
+		"tolerance_min": d.toleranceMin,
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// defaultTolerance is the allowed deviation from the theoretical elongation,
+// in percent, used when a designation has no tolerance_min/tolerance_max.
+const defaultTolerance = 7.0
+
+// tendonSpec holds the inputs of the theoretical elongation of one designation.
+// Units follow the project sheet: length in ft, area in in², modulus in ksi,
+// jacking force in kips, angle change in radians and seating loss in inches.
+type tendonSpec struct {
+	length       float64
+	area         float64
+	modulus      float64
+	jackingForce float64
+	friction     float64
+	wobble       float64
+	angleChange  float64
+	seatingLoss  float64
+	// double is set from the cables of the designation, the tendon columns
+	// don't say how it is stressed.
+	double bool
+}
+
+// expectedElongation is the theoretical elongation of a designation with its
+// tolerance band, all in inches.
+type expectedElongation struct {
+	theoretical float64
+	min         float64
+	max         float64
+}
+
+var tendonColumns = []string{"tendon_length", "strand_area", "modulus", "jacking_force"}
+
+// parseTendonSpec reads the tendon columns of a Manipulate row. ok is false
+// when the row carries no tendon data at all.
+func parseTendonSpec(line map[string]string) (spec tendonSpec, ok bool, err error) {
+	required := make([]float64, len(tendonColumns))
+	given := 0
+	for i, col := range tendonColumns {
+		if line[col] == "" {
+			continue
+		}
+		given++
+		required[i], err = strconv.ParseFloat(line[col], 64)
+		if err != nil || required[i] <= 0 {
+			return spec, false, fmt.Errorf("%s must be a positive number, got %q", col, line[col])
+		}
+	}
+	if given == 0 {
+		return spec, false, nil
+	}
+	if given != len(tendonColumns) {
+		return spec, false, fmt.Errorf("tendon data needs all of %v", tendonColumns)
+	}
+
+	spec = tendonSpec{
+		length:       required[0],
+		area:         required[1],
+		modulus:      required[2],
+		jackingForce: required[3],
+	}
+	optional := []struct {
+		col string
+		dst *float64
+	}{
+		{"friction_coefficient", &spec.friction},
+		{"wobble_coefficient", &spec.wobble},
+		{"angle_change", &spec.angleChange},
+		{"seating_loss", &spec.seatingLoss},
+	}
+	for _, o := range optional {
+		if line[o.col] == "" {
+			continue
+		}
+		*o.dst, err = strconv.ParseFloat(line[o.col], 64)
+		if err != nil || *o.dst < 0 {
+			return spec, false, fmt.Errorf("%s must be a non-negative number, got %q", o.col, line[o.col])
+		}
+	}
+	return spec, true, nil
+}
+
+// elongation returns the theoretical elongation in inches. The jacking force
+// is reduced along the tendon by curvature friction and wobble, so the average
+// force over the stressed length is P0·(1-e^-z)/z with z = μα + kx. Double
+// stressed tendons are stressed from both ends, each end covering half of the
+// length and half of the angle change.
+func (t tendonSpec) elongation() float64 {
+	length, angle, ends := t.length, t.angleChange, 1.0
+	if t.double {
+		length, angle, ends = length/2, angle/2, 2
+	}
+
+	z := t.friction*angle + t.wobble*length
+	avgForce := t.jackingForce
+	if z > 1e-9 {
+		avgForce = t.jackingForce * (1 - math.Exp(-z)) / z
+	}
+
+	perEnd := avgForce*length*12/(t.area*t.modulus) - t.seatingLoss
+	return perEnd * ends
+}
+
+// tolerance reads a tolerance column of a Manipulate row, in percent. Only
+// an empty cell gets the default tolerance, 0 allows no deviation.
+func tolerance(line map[string]string, col string) (float64, error) {
+	if line[col] == "" {
+		return defaultTolerance, nil
+	}
+	tol, err := strconv.ParseFloat(line[col], 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number, got %q", col, line[col])
+	}
+	return tol, nil
+}
+
+// toleranceBand applies the designation's tolerances, given in percent, to the
+// theoretical elongation.
+func toleranceBand(theoretical, tolMin, tolMax float64) expectedElongation {
+	return expectedElongation{
+		theoretical: theoretical,
+		min:         theoretical * (1 - math.Abs(tolMin)/100),
+		max:         theoretical * (1 + math.Abs(tolMax)/100),
+	}
+}
+
+// designationElongations computes the expected elongation of every designation
+// that has tendon data, keyed by the normalized designation name. Whether a
+// designation is double stressed comes from the cables that use it, since
+// designation rows of JSON and CSV sources have no is_double; a designation
+// without cables falls back to the is_double of its row. A designation used
+// by single and double cables can't have one expected elongation.
+func designationElongations(lines []map[string]string, cables []cable) (res map[string]expectedElongation, issues []validationIssue) {
+	single, double := make(map[string]bool), make(map[string]bool)
+	for _, c := range cables {
+		if c.isDouble {
+			double[c.designation] = true
+		} else {
+			single[c.designation] = true
+		}
+	}
+	res = make(map[string]expectedElongation)
+	seen := make(map[string]bool)
+	for _, line := range lines {
+		name := designationName(line["Set Designation"])
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		spec, ok, err := parseTendonSpec(line)
+		if err != nil {
+			issues = append(issues, validationIssue{sheet: "Manipulate", row: rowOf(line), key: name, msg: err.Error()})
+			continue
+		}
+		if !ok {
+			continue
+		}
+		switch {
+		case single[name] && double[name]:
+			issues = append(issues, validationIssue{sheet: "Manipulate", row: rowOf(line), key: name,
+				msg: "designation with tendon data is used by single and double cables"})
+			continue
+		case double[name]:
+			spec.double = true
+		case !single[name]:
+			spec.double, _ = strconv.ParseBool(line["is_double"])
+		}
+		theoretical := spec.elongation()
+		if theoretical <= 0 {
+			issues = append(issues, validationIssue{sheet: "Manipulate", row: rowOf(line), key: name,
+				msg: "seating loss exceeds the theoretical elongation"})
+			continue
+		}
+		tolMin, errMin := tolerance(line, "tolerance_min")
+		tolMax, errMax := tolerance(line, "tolerance_max")
+		for _, err := range []error{errMin, errMax} {
+			if err != nil {
+				issues = append(issues, validationIssue{sheet: "Manipulate", row: rowOf(line), key: name, msg: err.Error()})
+			}
+		}
+		if errMin != nil || errMax != nil {
+			continue
+		}
+		res[name] = toleranceBand(theoretical, tolMin, tolMax)
+	}
+	return res, issues
+}
+
+func (e expectedElongation) toFirestore() map[string]interface{} {
+	return map[string]interface{}{
+		"theoretical_elongation": math.Round(e.theoretical*1000) / 1000,
+		"elongation_min":         math.Round(e.min*1000) / 1000,
+		"elongation_max":         math.Round(e.max*1000) / 1000,
+	}
+}
@@ -3,8 +3,8 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
-	"log"
 	"math"
 	"os"
 	"strconv"
@@ -12,10 +12,8 @@ import (
 	"time"
 
 	"cloud.google.com/go/firestore"
-	firebase "firebase.google.com/go"
 	auth "firebase.google.com/go/auth"
 	"github.com/tealeg/xlsx"
-	"google.golang.org/api/option"
 )
 
 func readSheetToSliceOfMap(sheet *xlsx.Sheet) (res []map[string]string, err error) {
@@ -50,6 +48,7 @@ func readSheetToSliceOfMap(sheet *xlsx.Sheet) (res []map[string]string, err erro
 				}
 				vals[headers[j]] = fmt.Sprintf("%s", str)
 			}
+			vals[rowKey] = strconv.Itoa(i + 1)
 			res = append(res, vals)
 		}
 	}
@@ -117,34 +116,6 @@ func fileExists(name string) bool {
 	return true
 }
 
-func createLofErrorFile() (logFile *os.File) {
-	sdir, err := os.Getwd()
-	if err != nil {
-		panic(fmt.Sprintf("Fatal error in getting start directory: %v\n", err))
-	}
-	if fileExists(sdir + "/log_errors.txt") {
-		logFile, err = os.OpenFile(sdir+"/log_errors.txt", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-		if err != nil {
-			log.Fatal(err)
-		}
-		return logFile
-	}
-	logFile, err = os.Create(sdir + "/log_errors.txt")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return logFile
-}
-
-func doLogError(errStr string) {
-	logFile := createLofErrorFile()
-	defer logFile.Close()
-	log.SetOutput(logFile)
-	fmt.Printf("%v \n", errStr)
-	log.Fatal(errStr)
-}
-
 func roundSpecial(value string) interface{} {
 	var x interface{}
 	x, err := strconv.ParseFloat(value, 64)
@@ -155,84 +126,239 @@ func roundSpecial(value string) interface{} {
 	return strconv.FormatFloat(math.Round(x.(float64)*100)/100, 'f', 2, 64)
 }
 
+// commands are the subcommands of the program. Arguments that don't start
+// with a command name go to upload, so "firestoreUpload project1.xlsx" works
+// as before.
+var commands = map[string]func(args []string){
+	"upload":     runUpload,
+	"validate":   runValidate,
+	"render-map": runRenderMap,
+	"report":     runReport,
+	"history":    runHistory,
+	"rollback":   runRollback,
+	"template":   runTemplate,
+	"serve":      runServe,
+	"watch":      runWatch,
+}
+
 func main() {
-	var xlsxPath string
-	if len(os.Args) < 2 {
-		xlsxPath = "upload_sheet.xlsx"
-	} else {
-		xlsxPath = os.Args[1]
-	}
-	fmt.Printf("Use %q file as data source \n", xlsxPath)
-
-	userlines := make([]map[string]string, 0, 0)
-	projectlines := make([]map[string]string, 0, 0)
-	measurementlines := make([]map[string]string, 0, 0)
-	designationlines := make([]map[string]string, 0, 0)
-	measurementrefslines := make([]map[string]string, 0, 0)
-	contactlines := make([]map[string]string, 0, 0)
-	userlines, projectlines, measurementlines, designationlines, measurementrefslines, contactlines, err := readFromSourceExcel(xlsxPath)
+	name, args := "upload", os.Args[1:]
+	if len(args) > 0 {
+		if _, ok := commands[args[0]]; ok {
+			name, args = args[0], args[1:]
+		}
+	}
+	commands[name](args)
+	exit(0)
+}
+
+func runValidate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	lf := addLogFlags(fs)
+	sf := addSourceFlags(fs)
+	fs.Parse(args)
+	lf.apply()
+	src := sf.load(fs)
+
+	logIssues(applog, src.issues)
+	errs, warnings := splitIssues(src.issues)
+	applog.info("Validation done", "problems", len(errs), "warnings", len(warnings))
+	if len(errs) != 0 {
+		exit(1)
+	}
+}
+
+func runUpload(args []string) {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	lf := addLogFlags(fs)
+	pf := addProfileFlags(fs, true)
+	sf := addSourceFlags(fs)
+	bucket := fs.String("bucket", "", "storage bucket for project images (default: the Firebase project's default bucket)")
+	storageDir := fs.String("storage-dir", "", "store project images in this local directory instead of Firebase Storage")
+	history := fs.Bool("history", false, "save the prior state of changed projects and measurements in their history subcollection")
+	workers := fs.Int("workers", 8, "number of documents written at the same time")
+	rate := fs.Float64("rate", 500, "maximum document writes per second, 0 for no limit")
+	attempts := fs.Int("retries", 5, "attempts of a Firestore or Auth call that fails with a transient error")
+	retryBudget := fs.Int("retry-budget", 200, "retries the whole upload may spend before it stops")
+	retryWait := fs.Duration("retry-wait", 500*time.Millisecond, "backoff before the first retry, doubled for every further one")
+	rpcTimeout := fs.Duration("rpc-timeout", 30*time.Second, "deadline of a single Firestore or Auth call, 0 for none")
+	timeout := fs.Duration("timeout", 0, "deadline of the whole upload, 0 for none")
+	dryRun := fs.Bool("dry-run", false, "only print what the upload would write, without writing anything")
+	requestedBy := fs.String("requested-by", "", "e-mail of the user the upload is run for, recorded with the upload run (set by serve)")
+	nf := addNotifyFlags(fs)
+	rtdbURL := fs.String("rtdb-url", "", "also write the project tree to this Realtime Database, https://{name}.firebaseio.com")
+	rtdbPath := fs.String("rtdb-path", "", "path of the Realtime Database the project tree is written below (default: the root)")
+	fs.Parse(args)
+	lf.apply()
+	pf.load()
+	if err := nf.check(); err != nil {
+		applog.fatal(err.Error())
+	}
+	src := sf.load(fs)
+	if *rtdbURL != "" {
+		src.issues = append(src.issues, checkMirrorKeys(src)...)
+	}
+
+	logIssues(applog, src.issues)
+	if errs, _ := splitIssues(src.issues); len(errs) != 0 {
+		applog.fatal("Source data has problems, nothing was uploaded", "problems", len(errs))
+	}
+
+	ctx := rootContext(*timeout, true)
+	app := openApp(ctx)
+	firestoreClient, err := openFirestore(ctx, app)
 	if err != nil {
-		doLogError(err.Error())
+		applog.fatal("Can't open Firestore", "err", err)
 	}
+	atExit(func() { firestoreClient.Close() })
 
-	opt := option.WithCredentialsFile("serviceAccountKey.json")
-	ctx := context.Background()
+	if *dryRun {
+		plan, err := makePlan(ctx, app, firestoreClient, src)
+		if err != nil {
+			applog.fatal("Can't make the upload plan", "err", err)
+		}
+		fmt.Println(plan)
+		logIssues(applog, plan.issues)
+		if len(plan.issues) != 0 {
+			applog.fatal("Status changes are not allowed", "problems", len(plan.issues))
+		}
+		notifier, err := nf.open(ctx, app, firestoreClient, true)
+		if err != nil {
+			applog.fatal("Can't open Cloud Messaging", "err", err)
+		}
+		if notifier != nil {
+			planned := make(map[string]plannedProject)
+			for _, p := range plan.projects {
+				planned[p.id] = p
+			}
+			for _, line := range src.projectlines {
+				if p, ok := planned[line["project_id"]]; ok {
+					notifier.notify(ctx, line, p.change, p.documents, "")
+				}
+			}
+		}
+		return
+	}
 
-	app, err := firebase.NewApp(ctx, nil, opt)
+	statusChanges, statusIssues, err := planStatusChanges(ctx, firestoreClient, src.projectlines)
 	if err != nil {
-		doLogError(fmt.Sprintf("Error initializing app: '%v'", err))
+		applog.fatal("Can't read project status", "err", err)
+	}
+	if len(statusIssues) != 0 {
+		logIssues(applog, statusIssues)
+		applog.fatal("Status changes are not allowed, nothing was uploaded", "problems", len(statusIssues))
 	}
-	firestoreClient, err := app.Firestore(ctx)
+
+	notifier, err := nf.open(ctx, app, firestoreClient, false)
 	if err != nil {
-		doLogError(err.Error())
+		applog.fatal("Can't open Cloud Messaging", "err", err)
+	}
+
+	var store objectStore
+	if hasLocalImages(src.projectlines, src.dir()) {
+		store, err = openObjectStore(ctx, app, *bucket, *storageDir)
+		if err != nil {
+			applog.fatal("Can't open Storage bucket", "err", err)
+		}
 	}
-	defer firestoreClient.Close()
 
-	if len(userlines) != 0 {
-		fmt.Printf("Create user records:")
+	var mirror *rtdbMirror
+	if *rtdbURL != "" {
+		mirror, err = openMirror(ctx, *rtdbURL, *rtdbPath)
+		if err != nil {
+			applog.fatal("Can't open Realtime Database", "url", *rtdbURL, "err", err)
+		}
+	}
+
+	pf.confirm("UPLOAD TO")
+	run, err := newUploadRun(src.path)
+	if err != nil {
+		applog.fatal("Can't start upload run", "err", err)
+	}
+	run.requestedBy = *requestedBy
+	if mirror != nil {
+		run.rtdbURL, run.rtdbPath = mirror.url, mirror.root
+	}
+	up, err := newUploader(ctx, firestoreClient, run, uploadOptions{
+		history: *history, workers: *workers, rate: *rate,
+		attempts: *attempts, retryBudget: *retryBudget, retryWait: *retryWait, rpcTimeout: *rpcTimeout,
+		mirror: mirror,
+	})
+	if err != nil {
+		applog.fatal("Can't write upload run record", "run", run.id, "err", err)
+	}
+	log := up.log
+	log.info("Upload started", "path", src.path, "sha256", run.workbookSHA256)
+
+	if len(src.userlines) != 0 {
+		log.info("Creating user records", "rows", len(src.userlines))
 		authClient, err := app.Auth(ctx)
 		if err != nil {
-			doLogError(fmt.Sprintf("Error getting Auth client: %v\n", err))
+			up.fail("Can't open Auth client", "err", err)
 		}
-		for _, line := range userlines {
-			u, err := authClient.GetUserByEmail(ctx, line["identifier"])
+		for _, line := range src.userlines {
+			if isInterrupted() {
+				up.interrupt()
+			}
+			rowlog := []interface{}{"sheet", "Users", "row", rowOf(line), "email", line["identifier"]}
+			var u *auth.UserRecord
+			err := up.retry("auth_users", func(ctx context.Context) (err error) {
+				u, err = authClient.GetUserByEmail(ctx, line["identifier"])
+				return err
+			})
 			if err != nil {
 				if !strings.Contains(err.Error(), "cannot find user from email") {
-					doLogError(fmt.Sprintf("Error getting user by email %s: %v\n", line["identifier"], err))
+					up.fail("Can't look up user", append(rowlog, "err", err)...)
 				}
 			}
 			if u != nil {
+				log.debug("User exists", rowlog...)
 				continue
 			}
-			fmt.Print(".")
 			params := (&auth.UserToCreate{}).
 				Email(line["identifier"]).
 				EmailVerified(false).
 				Password("~1234@56%7&8xlongxx#Vsa232fshort").
 				Disabled(false)
 
-			UserRecord, err := authClient.CreateUser(ctx, params)
+			var UserRecord *auth.UserRecord
+			attempt := 0
+			err = up.retry("auth_users", func(ctx context.Context) (err error) {
+				attempt++
+				UserRecord, err = authClient.CreateUser(ctx, params)
+				if attempt > 1 && auth.IsEmailAlreadyExists(err) {
+					// An earlier attempt created the account but its
+					// response was lost.
+					UserRecord, err = authClient.GetUserByEmail(ctx, line["identifier"])
+				}
+				return err
+			})
 			if err != nil {
-				doLogError(fmt.Sprintf("error creating user: %v\n", err))
+				run.record("auth_users", func(c *uploadCounts) { c.errors++ })
+				up.fail("Can't create user", append(rowlog, "err", err)...)
 			}
+			run.record("auth_users", func(c *uploadCounts) { c.created++ })
+			log.debug("Created user", append(rowlog, "uid", UserRecord.UID)...)
 
-			_, err = firestoreClient.Collection("users").Doc(UserRecord.UID).Set(ctx, map[string]interface{}{
+			err = up.set(firestoreClient.Collection(collection(usersCollection)).Doc(UserRecord.UID), map[string]interface{}{
 				"first_name": line["first_name"],
 				"last_name":  line["last_name"],
 				"role":       line["role"],
 			}, firestore.MergeAll)
+			if err != nil {
+				up.fail("Can't add user", append(rowlog, "err", err)...)
+			}
 		}
 	}
 
 	var projectID string
 	var totalcables int
-	prcollname := "project"
-	fmt.Println()
-	fmt.Print("Add project details:")
-	for _, line := range projectlines {
-		fmt.Print(".")
+	prcollname := collection(projectCollection)
+	log.info("Adding project details", "rows", len(src.projectlines))
+	for _, line := range src.projectlines {
 		if line["project_id"] != "" {
 			projectID = line["project_id"]
+			rowlog := []interface{}{"sheet", "Project", "row", rowOf(line), "project", projectID}
 			var startdate interface{}
 			if line["start_date"] == "" {
 				startdate = nil
@@ -266,8 +392,7 @@ func main() {
 			area, _ := strconv.Atoi(line["area"])
 			totalcables, _ = strconv.Atoi(line["total_cables"])
 			averagedeviation, _ := strconv.Atoi(line["average_deviation"])
-			status, _ := strconv.Atoi(line["status"])
-			_, err = firestoreClient.Collection(prcollname).Doc(projectID).Set(ctx, map[string]interface{}{
+			project := map[string]interface{}{
 				"address_line_1":           line["address_line_1"],
 				"address_line_2":           line["address_line_2"],
 				"area":                     area,
@@ -294,117 +419,108 @@ func main() {
 				"pt_specification":         line["pt_specification"],
 				"pump":                     line["pump"],
 				"ram":                      line["ram"],
-				"ram_certification_image": line["ram_certification_image"],
-				"sheet":                   line["sheet"],
-				"start_date":              startdate,
-				"status":                  status,
-				"stressing_company_name":  line["stressing_company_name"],
-				"stressing_location":      line["stressing_location"],
-				"total_cables":            totalcables,
-				"weather":                 line["weather"],
-				"work_order_number":       line["work_order_number"],
-			}, firestore.MergeAll)
+				"ram_certification_image":  line["ram_certification_image"],
+				"sheet":                    line["sheet"],
+				"start_date":               startdate,
+				"stressing_company_name":   line["stressing_company_name"],
+				"stressing_location":       line["stressing_location"],
+				"total_cables":             totalcables,
+				"weather":                  line["weather"],
+				"work_order_number":        line["work_order_number"],
+			}
+			applyStatus(project, statusChanges[projectID], time.Now())
+			if force, err := calibrationForce(line, src.curves); err == nil {
+				project["calibration_force"] = math.Round(force*100) / 100
+			}
+			if store != nil {
+				if err := uploadProjectImages(ctx, store, projectID, line, src.dir(), project); err != nil {
+					up.fail("Can't upload project images", append(rowlog, "err", err)...)
+				}
+			}
+			run.addProject(projectID)
+			project["last_upload_run"] = run.id
+			// The project is written before anything is queued for its
+			// subcollections.
+			err = up.set(firestoreClient.Collection(prcollname).Doc(projectID), project, firestore.MergeAll)
 			if err != nil {
-				doLogError(fmt.Sprintf("Failed adding %v: %v", line, err))
+				up.fail("Can't add project", append(rowlog, "err", err)...)
+			}
+			for _, key := range src.curveOrder {
+				up.queue(firestoreClient.Collection(prcollname).Doc(projectID).Collection("calibrations").
+					Doc(key), src.curves[key].toFirestore(), append(rowlog, "calibration", key))
 			}
 		}
 	}
 
-	fmt.Println()
-	fmt.Print("Add measurements:")
-	k := 0
-	for _, line := range measurementlines {
-		cableorder, _ := strconv.Atoi(line["is_second_end"])
-		if cableorder != 1 {
-			fmt.Print(".")
-			isDouble, _ := strconv.ParseBool(line["is_double"])
-			_, err = firestoreClient.Collection(prcollname).Doc(projectID).Collection("measurements").
-				Doc(projectID+"-"+"measurement"+"-"+strconv.Itoa(k+1)).Set(ctx, map[string]interface{}{
-				"designation": roundSpecial(line["Set Designation"]),
-				"is_double":   isDouble,
-				"cable_id":    line["cable_id"],
-			}, firestore.MergeAll)
-			if err != nil {
-				doLogError(fmt.Sprintf("Failed adding %v: %v", line, err))
-			}
-			k++
-		}
+	log = log.with("project", projectID)
+	log.info("Adding measurements", "cables", len(src.cables))
+	for k, c := range src.cables {
+		up.queue(firestoreClient.Collection(prcollname).Doc(projectID).Collection("measurements").
+			Doc(projectID+"-"+"measurement"+"-"+strconv.Itoa(k+1)), c.toFirestore(),
+			[]interface{}{"project", projectID, "sheet", "Manipulate", "cable_id", c.id}, firestore.MergeAll)
 	}
 
-	fmt.Println()
-	fmt.Print("Add designations:")
-	type designationT struct {
-		name         string
-		toleranceMax float64
-		toleranceMin float64
-	}
-	designationsunique := make(map[designationT]bool, 0)
-	k = 0
-	for _, line := range designationlines {
-		toleranceMax, _ := strconv.ParseFloat(line["tolerance_max"], 64)
-		toleranceMin, _ := strconv.ParseFloat(line["tolerance_min"], 64)
-		_, is := designationsunique[designationT{line["Set Designation"], 0, 0}]
-		if is {
-			continue
-		}
-		fmt.Print(".")
-
-		_, err = firestoreClient.Collection(prcollname).Doc(projectID).Collection("designations").
-			Doc(projectID+"-"+"designation"+"-"+strconv.Itoa(k+1)).Set(ctx, map[string]interface{}{
-			"name":          roundSpecial(line["Set Designation"]),
-			"tolerance_max": toleranceMax,
-			"tolerance_min": toleranceMin,
-		}, firestore.MergeAll)
-		if err != nil {
-			doLogError(fmt.Sprintf("Failed adding %v: %v", line, err))
+	log.info("Adding designations", "designations", len(src.designations))
+	for k, d := range src.designations {
+		doc := d.toFirestore()
+		if e, ok := src.expected[d.name]; ok {
+			for field, v := range e.toFirestore() {
+				doc[field] = v
+			}
 		}
-		designationsunique[designationT{line["Set Designation"], 0, 0}] = true
-		k++
+		up.queue(firestoreClient.Collection(prcollname).Doc(projectID).Collection("designations").
+			Doc(projectID+"-"+"designation"+"-"+strconv.Itoa(k+1)), doc,
+			[]interface{}{"project", projectID, "sheet", "Manipulate", "designation", d.name}, firestore.MergeAll)
 	}
 
-	fmt.Println()
-	fmt.Print("Add measurement-refs:")
-	for j, line := range measurementrefslines {
-		fmt.Print(".")
+	log.info("Adding measurement-refs", "rows", len(src.measurementrefslines))
+	for j, line := range src.measurementrefslines {
 		var cableid string
 		cableid = line["cable_id"]
-		x, _ := strconv.Atoi(line["x"])
-		y, _ := strconv.Atoi(line["y"])
-		_, err = firestoreClient.Collection(prcollname).Doc(projectID).Collection("measurement-refs").
-			Doc(projectID+"-"+"measurement-ref"+"-"+strconv.Itoa(j+1)).Set(ctx, map[string]interface{}{
+		x, y, _, _ := markerPosition(line)
+		up.queue(firestoreClient.Collection(prcollname).Doc(projectID).Collection("measurement-refs").
+			Doc(projectID+"-"+"measurement-ref"+"-"+strconv.Itoa(j+1)), map[string]interface{}{
 			"cable_id": cableid,
 			"end_id":   line["end_id"],
 			"order_id": j,
 			"suffix":   line["suffix"],
 			"x":        x,
 			"y":        y,
-		}, firestore.MergeAll)
-		if err != nil {
-			doLogError(fmt.Sprintf("Failed adding %v: %v", line, err))
-		}
+		}, []interface{}{"project", projectID, "sheet", "Manipulate", "row", rowOf(line)}, firestore.MergeAll)
 	}
 
-	fmt.Println()
-	fmt.Print("Add contacts:")
-	for j, line := range contactlines {
-		fmt.Print(".")
+	log.info("Adding contacts", "rows", len(src.contactlines))
+	for j, line := range src.contactlines {
 		if line["email"] != "" {
 			status, _ := strconv.Atoi(line["status"])
-			_, err = firestoreClient.Collection(prcollname).Doc(projectID).Collection("contacts").
-				Doc(projectID+"-"+"contact"+"-"+strconv.Itoa(j+1)).Set(ctx, map[string]interface{}{
+			up.queue(firestoreClient.Collection(prcollname).Doc(projectID).Collection("contacts").
+				Doc(projectID+"-"+"contact"+"-"+strconv.Itoa(j+1)), map[string]interface{}{
 				"email":      line["email"],
 				"name":       line["name"],
 				"statusType": status,
-			})
-			if err != nil {
-				doLogError(fmt.Sprintf("Failed adding %v: %v", line, err))
+			}, []interface{}{"project", projectID, "sheet", "Contacts", "row", rowOf(line)})
+		}
+	}
+
+	up.flush()
+	if err = up.finish(""); err != nil {
+		log.fatal("Can't write upload run record", "err", err)
+	}
+
+	if notifier != nil {
+		for _, line := range src.projectlines {
+			if id := line["project_id"]; id != "" {
+				notifier.notify(ctx, line, statusChanges[id], run.written(id), run.id)
 			}
 		}
 	}
 
-	fmt.Println()
+	log.info("Upload finished", "projects", len(run.projects))
+	fmt.Println(run.summary())
 	fmt.Println("Job done!")
-	fmt.Println("Press the Enter Key to quit!")
-	var input string
-	fmt.Scanln(&input)
+	// Keeps the console window of a double-clicked program open.
+	if stdinIsTerminal() {
+		fmt.Println("Press the Enter Key to quit!")
+		readLine()
+	}
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// historyCollection is the subcollection that keeps prior versions of a
+// document. A version is named by the upload run that replaced it.
+const historyCollection = "history"
+
+// historyCollections are the collections whose documents get a history when
+// the upload runs with -history.
+var historyCollections = map[string]bool{
+	"project":      true,
+	"measurements": true,
+}
+
+// saveHistory copies the state of a document before it is changed by runID.
+func saveHistory(ctx context.Context, snap *firestore.DocumentSnapshot, runID string) (*firestore.WriteResult, error) {
+	return snap.Ref.Collection(historyCollection).Doc(runID).Set(ctx, map[string]interface{}{
+		"data":       snap.Data(),
+		"saved_at":   time.Now(),
+		"upload_run": runID,
+		"updated_at": snap.UpdateTime,
+	})
+}
+
+func runHistory(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	lf := addLogFlags(fs)
+	pf := addProfileFlags(fs, true)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: firestoreUpload history list <project_id>")
+		fmt.Fprintln(fs.Output(), "       firestoreUpload history restore <project_id> <run_id>")
+	}
+	fs.Parse(args)
+	lf.apply()
+	if fs.NArg() < 2 || (fs.Arg(0) == "restore" && fs.NArg() < 3) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	pf.load()
+
+	ctx := rootContext(0, false)
+	client, err := openFirestore(ctx, openApp(ctx))
+	if err != nil {
+		applog.fatal("Can't open Firestore", "err", err)
+	}
+	atExit(func() { client.Close() })
+	project := client.Collection(collection(projectCollection)).Doc(fs.Arg(1))
+
+	switch fs.Arg(0) {
+	case "list":
+		err = listHistory(ctx, project)
+	case "restore":
+		pf.confirm("RESTORE ON")
+		err = restoreHistory(ctx, client, project, fs.Arg(2))
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		applog.fatal(err.Error(), "project", project.ID)
+	}
+}
+
+// listHistory prints the saved versions of a project, newest first, with the
+// number of measurements saved by the same run.
+func listHistory(ctx context.Context, project *firestore.DocumentRef) error {
+	measurements := make(map[string]int)
+	err := eachSnapshot(project.Collection("measurements").Documents(ctx), func(m *firestore.DocumentSnapshot) error {
+		return eachSnapshot(m.Ref.Collection(historyCollection).Documents(ctx), func(h *firestore.DocumentSnapshot) error {
+			measurements[h.Ref.ID]++
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Versions of project %s:\n", project.ID)
+	n := 0
+	err = eachSnapshot(project.Collection(historyCollection).OrderBy("saved_at", firestore.Desc).Documents(ctx), func(h *firestore.DocumentSnapshot) error {
+		n++
+		savedAt, _ := h.Data()["saved_at"].(time.Time)
+		data, _ := h.Data()["data"].(map[string]interface{})
+		fmt.Printf("  %s  replaced on %s  status %v  %d measurement(s)\n",
+			h.Ref.ID, savedAt.Local().Format("2006-01-02 15:04"), data["status_name"], measurements[h.Ref.ID])
+		delete(measurements, h.Ref.ID)
+		return nil
+	})
+	if n == 0 {
+		fmt.Println("  none")
+	}
+	for runID, count := range measurements {
+		fmt.Printf("  %s  %d measurement(s) only\n", runID, count)
+	}
+	return err
+}
+
+// restoreHistory puts the project and its measurements back into the state
+// they had before runID. The current state is saved as a version first, so a
+// restore can be undone as well. When runID mirrored the project tree to the
+// Realtime Database, the restored documents are put back there too.
+func restoreHistory(ctx context.Context, client *firestore.Client, project *firestore.DocumentRef, runID string) error {
+	restoreID, err := newRunID(time.Now())
+	if err != nil {
+		return err
+	}
+	restoreID = "restore-" + restoreID
+
+	var mirror *rtdbMirror
+	run, err := client.Collection(collection(uploadsCollection)).Doc(runID).Get(ctx)
+	if err == nil {
+		mirror, err = openRunMirror(ctx, run.Data())
+	}
+	if err != nil && status.Code(err) != codes.NotFound {
+		return fmt.Errorf("opening the Realtime Database the run mirrored to: %v", err)
+	}
+
+	restored := 0
+	restore := func(ref *firestore.DocumentRef) error {
+		h, err := ref.Collection(historyCollection).Doc(runID).Get(ctx)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data, _ := h.Data()["data"].(map[string]interface{})
+		var currentData map[string]interface{}
+		if current, err := ref.Get(ctx); err == nil {
+			if _, err = saveHistory(ctx, current, restoreID); err != nil {
+				return err
+			}
+			currentData = current.Data()
+		} else if status.Code(err) != codes.NotFound {
+			return err
+		}
+		if _, err = ref.Set(ctx, data); err != nil {
+			return err
+		}
+		restored++
+		if path := relativePath(ref); mirror != nil && mirrored(path) {
+			if err = mirror.restore(ctx, path, data, currentData); err != nil {
+				return fmt.Errorf("restoring %s in the Realtime Database: %v", path, err)
+			}
+		}
+		return nil
+	}
+
+	if err = restore(project); err != nil {
+		return err
+	}
+	err = eachSnapshot(project.Collection("measurements").Documents(ctx), func(m *firestore.DocumentSnapshot) error {
+		return restore(m.Ref)
+	})
+	if err != nil {
+		return err
+	}
+	if restored == 0 {
+		return fmt.Errorf("project %s has no version saved by run %s", project.ID, runID)
+	}
+	applog.info("Project restored", "project", project.ID, "run", runID, "documents", restored)
+	applog.info("The replaced state is saved as a version", "project", project.ID, "version", restoreID)
+	return nil
+}
+
+func eachSnapshot(iter *firestore.DocumentIterator, fn func(*firestore.DocumentSnapshot) error) error {
+	defer iter.Stop()
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(snap); err != nil {
+			return err
+		}
+	}
+}
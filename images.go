@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	firebase "firebase.google.com/go"
+)
+
+// imageColumns are the project columns that reference an image. People tend
+// to paste local file paths there, which the uploader replaces with files in
+// Firebase Storage.
+var imageColumns = []string{"device_calibration_image", "map_image", "ram_certification_image"}
+
+// downloadTokenKey is the object metadata the Firebase download URLs are
+// authorized with.
+const downloadTokenKey = "firebaseStorageDownloadTokens"
+
+// objectStore is the part of Cloud Storage the image upload uses, so a local
+// directory can stand in for the bucket.
+type objectStore interface {
+	// token returns the download token of an existing object, ok is false
+	// when there is no such object.
+	token(ctx context.Context, name string) (token string, ok bool, err error)
+	put(ctx context.Context, name, contentType string, data []byte, token string) error
+	downloadURL(name, token string) string
+}
+
+// openObjectStore returns the local stand-in when dir is set, otherwise the
+// named bucket or the default bucket of the Firebase project.
+func openObjectStore(ctx context.Context, app *firebase.App, bucket, dir string) (objectStore, error) {
+	if dir != "" {
+		return dirStore{dir}, nil
+	}
+	client, err := app.Storage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var b *storage.BucketHandle
+	if bucket == "" {
+		b, err = client.DefaultBucket()
+	} else {
+		b, err = client.Bucket(bucket)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newBucketStore(ctx, b)
+}
+
+type bucketStore struct {
+	bucket *storage.BucketHandle
+	name   string
+}
+
+func newBucketStore(ctx context.Context, bucket *storage.BucketHandle) (*bucketStore, error) {
+	attrs, err := bucket.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &bucketStore{bucket, attrs.Name}, nil
+}
+
+func (b *bucketStore) token(ctx context.Context, name string) (string, bool, error) {
+	attrs, err := b.bucket.Object(name).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return strings.Split(attrs.Metadata[downloadTokenKey], ",")[0], true, nil
+}
+
+func (b *bucketStore) put(ctx context.Context, name, contentType string, data []byte, token string) error {
+	w := b.bucket.Object(name).NewWriter(ctx)
+	w.ContentType = contentType
+	w.Metadata = map[string]string{downloadTokenKey: token}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (b *bucketStore) downloadURL(name, token string) string {
+	return fmt.Sprintf("https://firebasestorage.googleapis.com/v0/b/%s/o/%s?alt=media&token=%s",
+		b.name, url.PathEscape(name), token)
+}
+
+// dirStore keeps objects as files below a local directory, with the download
+// token next to each file.
+type dirStore struct {
+	root string
+}
+
+func (d dirStore) token(ctx context.Context, name string) (string, bool, error) {
+	token, err := ioutil.ReadFile(filepath.Join(d.root, filepath.FromSlash(name)) + ".token")
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	return string(token), err == nil, err
+}
+
+func (d dirStore) put(ctx context.Context, name, contentType string, data []byte, token string) error {
+	path := filepath.Join(d.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+".token", []byte(token), 0644)
+}
+
+func (d dirStore) downloadURL(name, token string) string {
+	abs, _ := filepath.Abs(filepath.Join(d.root, filepath.FromSlash(name)))
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs), RawQuery: "token=" + token}).String()
+}
+
+// imageExtensions are the file extensions a column value is taken as a
+// picture file by, even without a directory in front of it.
+var imageExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".bmp": true,
+	".tif": true, ".tiff": true, ".webp": true, ".heic": true, ".heif": true,
+}
+
+// storedImageName matches the storage paths uploadImage writes, which can be
+// pasted into the image columns as they are.
+var storedImageName = regexp.MustCompile(`^project/[^/]+/[0-9a-f]{64}(_full|_thumb)?\.(jpg|png)$`)
+
+// localImagePath returns the file a column value points at. Values that are
+// URLs or storage paths are left alone; every other value with a directory
+// or an image extension is a local file, whether it exists or not, so
+// checkImages can report the missing ones. Relative paths are taken relative
+// to the source workbook.
+func localImagePath(value, sourceDir string) (path string, ok bool) {
+	value = strings.TrimSpace(value)
+	if !isLocalImage(value) {
+		return "", false
+	}
+	if filepath.IsAbs(value) || looksLikeWindowsPath(value) {
+		return value, true
+	}
+	if p := filepath.Join(sourceDir, value); fileExists(p) || !fileExists(value) {
+		return p, true
+	}
+	return value, true
+}
+
+// isLocalImage tells whether a trimmed column value is a local file rather
+// than a URL or a storage path.
+func isLocalImage(value string) bool {
+	if value == "" || strings.Contains(value, "://") || storedImageName.MatchString(value) {
+		return false
+	}
+	return strings.ContainsAny(value, `/\`) || imageExtensions[strings.ToLower(filepath.Ext(value))]
+}
+
+func looksLikeWindowsPath(value string) bool {
+	return len(value) > 2 && value[1] == ':' && (value[2] == '\\' || value[2] == '/')
+}
+
+// checkImages reports local image paths that don't exist or aren't usable
+// pictures.
+func checkImages(projectlines []map[string]string, sourceDir string) (issues []validationIssue) {
+	for _, line := range projectlines {
+		if line["project_id"] == "" {
+			continue
+		}
+		for _, col := range imageColumns {
+			path, ok := localImagePath(line[col], sourceDir)
+			if !ok {
+				continue
+			}
+			if !fileExists(path) {
+				issues = append(issues, validationIssue{sheet: "Project", row: rowOf(line), key: line["project_id"],
+					msg: fmt.Sprintf("%s file %q does not exist", col, path)})
+			} else if err := checkImageFile(path); err != nil {
+				issues = append(issues, validationIssue{sheet: "Project", row: rowOf(line), key: line["project_id"],
+					msg: fmt.Sprintf("%s file %q: %v", col, path, err)})
+			}
+		}
+	}
+	return issues
+}
+
+// checkImageURLs reports local files in the image columns of a source that
+// may only reference images by URL or storage path. The files aren't looked
+// at, so the issues don't tell which of them exist.
+func checkImageURLs(projectlines []map[string]string) (issues []validationIssue) {
+	for _, line := range projectlines {
+		if line["project_id"] == "" {
+			continue
+		}
+		for _, col := range imageColumns {
+			if isLocalImage(strings.TrimSpace(line[col])) {
+				issues = append(issues, validationIssue{sheet: "Project", row: rowOf(line), key: line["project_id"],
+					msg: fmt.Sprintf("%s must be a URL or a storage path, local files can't be used here", col)})
+			}
+		}
+	}
+	return issues
+}
+
+// storedImage is an image file uploaded to storage.
+type storedImage struct {
+	path string
+	url  string
+}
+
+// uploadImage stores the full-size variant and the thumbnail of a picture
+// under project/{projectID}/, named by the SHA-256 of the original file, so
+// the same picture referenced twice or uploaded again is processed and stored
+// only once. The full-size variant is limited to maxSide; with 0 it keeps
+// the size of the picture and is named {sha256}_full.
+func uploadImage(ctx context.Context, store objectStore, projectID, path string, maxSide int) (full, thumb storedImage, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return full, thumb, err
+	}
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return full, thumb, err
+	}
+	sum := sha256.Sum256(data)
+	ext, _ := variantType(format)
+	base := "project/" + projectID + "/" + hex.EncodeToString(sum[:])
+	fullName, thumbName := base+ext, base+"_thumb"+ext
+	if maxSide == 0 {
+		fullName = base + "_full" + ext
+	}
+
+	fullToken, fullOK, err := store.token(ctx, fullName)
+	if err != nil {
+		return full, thumb, err
+	}
+	thumbToken, thumbOK, err := store.token(ctx, thumbName)
+	if err != nil {
+		return full, thumb, err
+	}
+	if !fullOK || !thumbOK {
+		fullV, thumbV, err := makeImageVariants(data, maxSide)
+		if err != nil {
+			return full, thumb, err
+		}
+		if !fullOK {
+			if fullToken, err = putObject(ctx, store, fullName, fullV); err != nil {
+				return full, thumb, err
+			}
+		}
+		if !thumbOK {
+			if thumbToken, err = putObject(ctx, store, thumbName, thumbV); err != nil {
+				return full, thumb, err
+			}
+		}
+	}
+	full = storedImage{fullName, store.downloadURL(fullName, fullToken)}
+	thumb = storedImage{thumbName, store.downloadURL(thumbName, thumbToken)}
+	return full, thumb, nil
+}
+
+func putObject(ctx context.Context, store objectStore, name string, v imageVariant) (token string, err error) {
+	token, err = newDownloadToken()
+	if err != nil {
+		return "", err
+	}
+	return token, store.put(ctx, name, v.contentType, v.data, token)
+}
+
+func newDownloadToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// uploadProjectImages replaces the local file paths in the image columns of a
+// project document with the download URL of the full-size variant. The
+// storage paths go to {column}_path and the thumbnail to {column}_thumbnail
+// and {column}_thumbnail_path. The map keeps its size, the x and y of the
+// measurement-refs are pixels on it.
+func uploadProjectImages(ctx context.Context, store objectStore, projectID string, line map[string]string, sourceDir string, project map[string]interface{}) error {
+	for _, col := range imageColumns {
+		path, ok := localImagePath(line[col], sourceDir)
+		if !ok {
+			continue
+		}
+		maxSide := fullImageSide
+		if col == "map_image" {
+			maxSide = 0
+		}
+		full, thumb, err := uploadImage(ctx, store, projectID, path, maxSide)
+		if err != nil {
+			return fmt.Errorf("uploading %s %q: %v", col, path, err)
+		}
+		project[col] = full.url
+		project[col+"_path"] = full.path
+		project[col+"_thumbnail"] = thumb.url
+		project[col+"_thumbnail_path"] = thumb.path
+	}
+	return nil
+}
+
+// hasLocalImages tells whether any project references a local image, so the
+// storage client is only set up when it's needed.
+func hasLocalImages(projectlines []map[string]string, sourceDir string) bool {
+	for _, line := range projectlines {
+		if line["project_id"] == "" {
+			continue
+		}
+		for _, col := range imageColumns {
+			if _, ok := localImagePath(line[col], sourceDir); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
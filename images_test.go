@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestImage writes a 400x300 picture in format to dir and returns its
+// path and the hex SHA-256 of the file.
+func writeTestImage(t *testing.T, dir, name, format string) (path, sum string) {
+	img := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	for x := 0; x < 400; x++ {
+		for y := 0; y < 300; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	default:
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(buf.Bytes())
+	return path, hex.EncodeToString(h[:])
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "firestoreUpload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLocalImagePath(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	existing, _ := writeTestImage(t, dir, "map.png", "png")
+	stored := "project/P1/" + strings.Repeat("ab", 32) + "_thumb.jpg"
+
+	tests := []struct {
+		value string
+		path  string
+		ok    bool
+	}{
+		{"", "", false},
+		{"https://example.com/map.jpg", "", false},
+		{"gs://bucket/project/P1/map.jpg", "", false},
+		{stored, "", false},
+		{strings.Replace(stored, "_thumb", "_full", 1), "", false},
+		{"see the binder", "", false},
+		{"map.png", existing, true},
+		{existing, existing, true},
+		{"photos/map.jpg", filepath.Join(dir, "photos", "map.jpg"), true},
+		{"missing.JPG", filepath.Join(dir, "missing.JPG"), true},
+		{`C:\Photos\map.jpg`, `C:\Photos\map.jpg`, true},
+	}
+	for _, tt := range tests {
+		path, ok := localImagePath(tt.value, dir)
+		if path != tt.path || ok != tt.ok {
+			t.Errorf("localImagePath(%q) = %q, %v, want %q, %v", tt.value, path, ok, tt.path, tt.ok)
+		}
+	}
+}
+
+func TestCheckImagesMissingRelativePath(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeTestImage(t, dir, "map.png", "png")
+
+	lines := []map[string]string{{
+		"project_id":               "P1",
+		"map_image":                "map.png",
+		"device_calibration_image": "photos/device.jpg",
+		"ram_certification_image":  "https://example.com/cert.jpg",
+	}}
+	issues := checkImages(lines, dir)
+	if len(issues) != 1 {
+		t.Fatalf("got issues %v, want one for device_calibration_image", issues)
+	}
+	if issue := issues[0]; issue.warning || !strings.Contains(issue.msg, "device_calibration_image") ||
+		!strings.Contains(issue.msg, "does not exist") {
+		t.Errorf("got issue %v, want an error about the missing device_calibration_image", issue)
+	}
+}
+
+func TestCheckImageURLs(t *testing.T) {
+	lines := []map[string]string{{
+		"project_id":               "P1",
+		"map_image":                "/etc/passwd.png",
+		"device_calibration_image": "../device.jpg",
+		"ram_certification_image":  "https://example.com/cert.jpg",
+	}, {
+		"project_id": "P2",
+		"map_image":  "project/P2/" + strings.Repeat("ab", 32) + "_full.png",
+	}}
+	issues := checkImageURLs(lines)
+	if len(issues) != 2 {
+		t.Fatalf("got issues %v, want one for map_image and device_calibration_image of P1", issues)
+	}
+	for _, issue := range issues {
+		if issue.key != "P1" || issue.warning || strings.Contains(issue.msg, "passwd") || strings.Contains(issue.msg, "device.jpg") {
+			t.Errorf("got issue %v, want an error without the path", issue)
+		}
+	}
+}
+
+func TestUploadImage(t *testing.T) {
+	tests := []struct {
+		format string
+		ext    string
+	}{
+		{"png", ".png"},
+		{"jpeg", ".jpg"},
+		{"gif", ".png"},
+	}
+	ctx := context.Background()
+	for _, tt := range tests {
+		dir := tempDir(t)
+		store := dirStore{filepath.Join(dir, "bucket")}
+		path, sum := writeTestImage(t, dir, "picture."+tt.format, tt.format)
+
+		full, thumb, err := uploadImage(ctx, store, "P1", path, fullImageSide)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.format, err)
+		}
+		if want := "project/P1/" + sum + tt.ext; full.path != want {
+			t.Errorf("%s: full-size object %q, want %q", tt.format, full.path, want)
+		}
+		if want := "project/P1/" + sum + "_thumb" + tt.ext; thumb.path != want {
+			t.Errorf("%s: thumbnail object %q, want %q", tt.format, thumb.path, want)
+		}
+		for _, img := range []storedImage{full, thumb} {
+			token, ok, err := store.token(ctx, img.path)
+			if err != nil || !ok {
+				t.Fatalf("%s: object %q not stored: %v", tt.format, img.path, err)
+			}
+			if want := store.downloadURL(img.path, token); img.url != want {
+				t.Errorf("%s: URL %q, want %q", tt.format, img.url, want)
+			}
+		}
+
+		// The same picture under another name is stored once, with the
+		// tokens of the first upload.
+		data, _ := ioutil.ReadFile(path)
+		copyPath := filepath.Join(dir, "copy."+tt.format)
+		if err := ioutil.WriteFile(copyPath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		full2, thumb2, err := uploadImage(ctx, store, "P1", copyPath, fullImageSide)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.format, err)
+		}
+		if full2 != full || thumb2 != thumb {
+			t.Errorf("%s: second upload gave %v %v, want %v %v", tt.format, full2, thumb2, full, thumb)
+		}
+		objects, _ := filepath.Glob(filepath.Join(store.root, "project", "P1", "*"+tt.ext))
+		if len(objects) != 2 {
+			t.Errorf("%s: stored objects %v, want the full-size picture and its thumbnail", tt.format, objects)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMakeImageVariants(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path, _ := writeTestImage(t, dir, "map.png", "png")
+	data, _ := ioutil.ReadFile(path)
+
+	tests := []struct {
+		maxSide int
+		w, h    int
+	}{
+		{0, 400, 300},
+		{200, 200, 150},
+	}
+	for _, tt := range tests {
+		full, thumb, err := makeImageVariants(data, tt.maxSide)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range []struct {
+			name string
+			data []byte
+			w, h int
+		}{{"full", full.data, tt.w, tt.h}, {"thumbnail", thumb.data, thumbnailSide, thumbnailSide * 3 / 4}} {
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(v.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != v.w || cfg.Height != v.h {
+				t.Errorf("maxSide %d: %s is %dx%d, want %dx%d", tt.maxSide, v.name, cfg.Width, cfg.Height, v.w, v.h)
+			}
+		}
+	}
+}
+
+func TestUploadProjectImages(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	store := dirStore{filepath.Join(dir, "bucket")}
+	_, sum := writeTestImage(t, dir, "map.png", "png")
+	writeTestImage(t, dir, "device.png", "png")
+
+	line := map[string]string{
+		"project_id":               "P1",
+		"map_image":                "map.png",
+		"device_calibration_image": "device.png",
+		"ram_certification_image":  "https://example.com/cert.jpg",
+	}
+	project := map[string]interface{}{
+		"map_image":                line["map_image"],
+		"device_calibration_image": line["device_calibration_image"],
+		"ram_certification_image":  line["ram_certification_image"],
+	}
+	if err := uploadProjectImages(context.Background(), store, "P1", line, dir, project); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"map_image_path":           "project/P1/" + sum + "_full.png",
+		"map_image_thumbnail_path": "project/P1/" + sum + "_thumb.png",
+	}
+	for field, path := range want {
+		if project[field] != path {
+			t.Errorf("%s = %v, want %q", field, project[field], path)
+		}
+	}
+	for _, col := range []string{"map_image", "device_calibration_image"} {
+		for _, variant := range []string{"", "_thumbnail"} {
+			path, _ := project[col+variant+"_path"].(string)
+			token, ok, err := store.token(context.Background(), path)
+			if err != nil || !ok {
+				t.Fatalf("%s%s_path %q is not stored: %v", col, variant, path, err)
+			}
+			if url := store.downloadURL(path, token); project[col+variant] != url {
+				t.Errorf("%s%s = %v, want %q", col, variant, project[col+variant], url)
+			}
+		}
+	}
+	if project["ram_certification_image"] != line["ram_certification_image"] {
+		t.Errorf("ram_certification_image = %v, want the URL left alone", project["ram_certification_image"])
+	}
+	if _, ok := project["ram_certification_image_path"]; ok {
+		t.Error("ram_certification_image_path is set for a URL")
+	}
+}
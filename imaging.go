@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+)
+
+// Limits of the images attached to projects. Larger phone photos are fine as
+// long as they fit into maxImagePixels, they are scaled down before storing.
+const (
+	maxImageBytes  = 25 << 20
+	maxImagePixels = 50000000
+	minImageSide   = 16
+	fullImageSide  = 2048
+	thumbnailSide  = 320
+	jpegQuality    = 85
+)
+
+// imageVariant is an encoded version of an attachment ready to be stored.
+type imageVariant struct {
+	data        []byte
+	contentType string
+}
+
+// checkImageFile validates format, size and dimensions of an attachment
+// without decoding the whole picture.
+func checkImageFile(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Size() > maxImageBytes {
+		return fmt.Errorf("file is %.1f MB, the limit is %d MB", float64(fi.Size())/(1<<20), maxImageBytes>>20)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	head := make([]byte, 32)
+	n, _ := f.Read(head)
+	if isHEIF(head[:n]) {
+		return fmt.Errorf("HEIC/HEIF pictures are not supported, save the picture as JPEG or PNG")
+	}
+	f.Seek(0, 0)
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("not a JPEG, PNG or GIF picture: %v", err)
+	}
+	if cfg.Width < minImageSide || cfg.Height < minImageSide {
+		return fmt.Errorf("%s picture is only %dx%d pixels", format, cfg.Width, cfg.Height)
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return fmt.Errorf("%s picture has %dx%d pixels, the limit is %d megapixels",
+			format, cfg.Width, cfg.Height, maxImagePixels/1000000)
+	}
+	return nil
+}
+
+// isHEIF recognizes the ftyp box of HEIC/HEIF files, which the standard
+// library can't decode.
+func isHEIF(head []byte) bool {
+	if len(head) < 12 || string(head[4:8]) != "ftyp" {
+		return false
+	}
+	switch string(head[8:12]) {
+	case "heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1":
+		return true
+	}
+	return false
+}
+
+// makeImageVariants decodes an attachment, applies its EXIF orientation and
+// returns a full-size variant limited to maxSide, 0 for no limit, and a
+// thumbnail. Photos are stored as JPEG, drawings and screenshots keep the
+// lossless PNG.
+func makeImageVariants(data []byte, maxSide int) (full, thumb imageVariant, err error) {
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return full, thumb, err
+	}
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(data)
+	}
+
+	img := toRGBA(src)
+	fullImg := img
+	if maxSide > 0 {
+		fullImg = downscale(img, maxSide)
+	}
+	if full.data, err = encodeVariant(orient(fullImg, orientation), format); err != nil {
+		return full, thumb, err
+	}
+	if thumb.data, err = encodeVariant(orient(downscale(img, thumbnailSide), orientation), format); err != nil {
+		return full, thumb, err
+	}
+	_, full.contentType = variantType(format)
+	thumb.contentType = full.contentType
+	return full, thumb, nil
+}
+
+// loadPicture decodes an image file and turns it upright.
+func loadPicture(path string) (*image.RGBA, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	return orient(toRGBA(src), orientation), nil
+}
+
+// pictureSize returns the dimensions of an image file once it is upright,
+// without decoding the pixels.
+func pictureSize(path string) (w, h int, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, err
+	}
+	if format == "jpeg" && jpegOrientation(data) >= 5 {
+		return cfg.Height, cfg.Width, nil
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// variantType is the file extension and content type the variants of a
+// picture in the given format are stored with.
+func variantType(format string) (ext, contentType string) {
+	if format == "jpeg" {
+		return ".jpg", "image/jpeg"
+	}
+	return ".png", "image/png"
+}
+
+func encodeVariant(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+func toRGBA(src image.Image) *image.RGBA {
+	if img, ok := src.(*image.RGBA); ok {
+		return img
+	}
+	b := src.Bounds()
+	img := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(img, img.Bounds(), src, b.Min, draw.Src)
+	return img
+}
+
+// downscale shrinks the image so that its longer side is at most maxSide,
+// averaging all source pixels that fall into a target pixel.
+func downscale(src *image.RGBA, maxSide int) *image.RGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w <= maxSide && h <= maxSide {
+		return src
+	}
+	dw, dh := maxSide, h*maxSide/w
+	if h > w {
+		dw, dh = w*maxSide/h, maxSide
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		y0, y1 := dy*h/dh, (dy+1)*h/dh
+		for dx := 0; dx < dw; dx++ {
+			x0, x1 := dx*w/dw, (dx+1)*w/dw
+			var sum [4]int
+			for y := y0; y < y1; y++ {
+				row := src.Pix[y*src.Stride+x0*4 : y*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			o := dy*dst.Stride + dx*4
+			for c := 0; c < 4; c++ {
+				dst.Pix[o+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// orient turns the pixels the way the EXIF orientation tag asks for, so the
+// app doesn't have to.
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var tx, ty int
+			switch orientation {
+			case 2:
+				tx, ty = w-1-x, y
+			case 3:
+				tx, ty = w-1-x, h-1-y
+			case 4:
+				tx, ty = x, h-1-y
+			case 5:
+				tx, ty = y, x
+			case 6:
+				tx, ty = h-1-y, x
+			case 7:
+				tx, ty = h-1-y, w-1-x
+			case 8:
+				tx, ty = y, w-1-x
+			}
+			copy(dst.Pix[ty*dst.Stride+tx*4:ty*dst.Stride+tx*4+4], src.Pix[y*src.Stride+x*4:y*src.Stride+x*4+4])
+		}
+	}
+	return dst
+}
+
+// jpegOrientation reads the orientation tag from the Exif APP1 segment of a
+// JPEG file. It returns 1, the normal orientation, when there is none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || size < 2 || i+2+size > len(data) {
+			// Start of scan, the metadata segments are over.
+			return 1
+		}
+		seg := data[i+4 : i+2+size]
+		if marker == 0xE1 && len(seg) > 6 && string(seg[:6]) == "Exif\x00\x00" {
+			return exifOrientation(seg[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for e := 0; e < entries; e++ {
+		p := ifd + 2 + e*12
+		if p+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[p:]) == 0x0112 {
+			return int(order.Uint16(tiff[p+8:]))
+		}
+	}
+	return 1
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// checkIntegrity cross-checks the parsed sheets: every row must belong to an
+// existing project, refs must point at real cable ends, measurements must use
+// a known designation and IDs must be unique.
+func checkIntegrity(src *sourceData) (issues []validationIssue) {
+	projects := make(map[string]bool)
+	for _, line := range src.projectlines {
+		id := line["project_id"]
+		if id == "" {
+			continue
+		}
+		if projects[id] {
+			issues = append(issues, validationIssue{sheet: "Project", row: rowOf(line), key: id, msg: "duplicate project_id"})
+		}
+		projects[id] = true
+	}
+	children := len(src.cables) != 0 || len(src.measurementrefslines) != 0 || len(src.contactlines) != 0
+	if len(projects) == 0 && children {
+		issues = append(issues, validationIssue{sheet: "Project",
+			msg: "no row with a project_id, measurements and contacts have no project to belong to"})
+	}
+	// The Manipulate rows don't name their project, so they and the contacts
+	// can only be written under the one project of the source.
+	if len(projects) > 1 && children {
+		issues = append(issues, validationIssue{sheet: "Project",
+			msg: fmt.Sprintf("%d projects with measurements or contacts, a source with measurements or contacts must have exactly one project", len(projects))})
+	}
+
+	designations := make(map[string]bool)
+	for _, d := range src.designations {
+		designations[d.name] = true
+	}
+	ends := make(map[string]map[string]bool)
+	for _, c := range src.cables {
+		if c.id == "" {
+			issues = append(issues, validationIssue{sheet: "Manipulate", key: c.designation,
+				msg: "orphan row without cable_id"})
+			continue
+		}
+		if c.designation == "" {
+			issues = append(issues, validationIssue{sheet: "Manipulate", key: c.id, msg: "cable has no Set Designation"})
+		} else if !designations[c.designation] {
+			issues = append(issues, validationIssue{sheet: "Manipulate", key: c.id,
+				msg: fmt.Sprintf("designation %q is not in the designations list", c.designation)})
+		}
+		ends[c.id] = make(map[string]bool)
+		for _, e := range c.ends {
+			ends[c.id][e.endID] = true
+		}
+	}
+	for _, line := range src.projectlines {
+		total, err := strconv.Atoi(line["total_cables"])
+		if line["project_id"] != "" && err == nil && total != len(ends) {
+			issues = append(issues, validationIssue{sheet: "Project", row: rowOf(line), key: line["project_id"], warning: true,
+				msg: fmt.Sprintf("total_cables is %d but the Manipulate sheet has %d cables", total, len(ends))})
+		}
+	}
+
+	refs := make(map[string]bool)
+	for _, line := range src.measurementrefslines {
+		id := line["cable_id"]
+		ref := strings.Join([]string{id, line["end_id"], line["suffix"]}, "/")
+		switch {
+		case id == "":
+			// Rows without a cable_id are reported with the measurements.
+			continue
+		case ends[id] == nil:
+			issues = append(issues, validationIssue{sheet: "Manipulate", row: rowOf(line), key: ref,
+				msg: fmt.Sprintf("measurement-ref points at unknown cable %q", id)})
+		case !ends[id][line["end_id"]]:
+			issues = append(issues, validationIssue{sheet: "Manipulate", row: rowOf(line), key: ref,
+				msg: fmt.Sprintf("measurement-ref points at unknown end %q of cable %q", line["end_id"], id)})
+		case refs[ref]:
+			issues = append(issues, validationIssue{sheet: "Manipulate", row: rowOf(line), key: ref, msg: "duplicate measurement-ref"})
+		}
+		refs[ref] = true
+	}
+
+	emails := make(map[string]bool)
+	for _, line := range src.contactlines {
+		email := strings.ToLower(strings.TrimSpace(line["email"]))
+		if email == "" {
+			continue
+		}
+		if id := line["project_id"]; id != "" && !projects[id] {
+			issues = append(issues, validationIssue{sheet: "Contacts", row: rowOf(line), key: email,
+				msg: fmt.Sprintf("contact belongs to unknown project %q", id)})
+		}
+		if emails[email] {
+			issues = append(issues, validationIssue{sheet: "Contacts", row: rowOf(line), key: email, msg: "duplicate contact email"})
+		}
+		emails[email] = true
+	}
+
+	return issues
+}
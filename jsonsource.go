@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The arrays nested in the project object of a JSON source.
+const (
+	jsonMeasurements    = "measurements"
+	jsonDesignations    = "designations"
+	jsonMeasurementRefs = "measurement_refs"
+	jsonContacts        = "contacts"
+)
+
+// dateColumns are the project columns that hold a date. Sheets give them as
+// mm-dd-yy, JSON sources may use yyyy-mm-dd as well.
+var dateColumns = []string{"start_date", "calibration_date", "engineer_submitted_at", "field_started_at", "field_submitted_at"}
+
+// jsonFields are the fields a row of each type may have, the properties of
+// its definition in source.schema.json. The Manipulate sheet is split into
+// measurements, designations and measurement-refs.
+var jsonFields = map[string][]string{
+	"user":            sheetColumns("Users"),
+	"project":         sheetColumns("Project"),
+	"contact":         sheetColumns("Contacts"),
+	"calibration":     sheetColumns(calibrationSheetName),
+	"measurement":     {"cable_id", "end_id", "suffix", "designation", "is_double", "is_second_end", "elongation"},
+	"measurement_ref": {"cable_id", "end_id", "suffix", "x", "y"},
+	"designation": {"designation", "tolerance_min", "tolerance_max", "is_double", "tendon_length", "strand_area",
+		"modulus", "jacking_force", "friction_coefficient", "wobble_coefficient", "angle_change", "seating_loss"},
+}
+
+// sheetColumns returns the column names of a sheet of the template.
+func sheetColumns(sheet string) []string {
+	for _, s := range templateSheets {
+		if s.name != sheet {
+			continue
+		}
+		names := make([]string, len(s.columns))
+		for i, col := range s.columns {
+			names[i] = col.name
+		}
+		return names
+	}
+	return nil
+}
+
+// jsonReader reads a source given as one JSON document: an object with a
+// project object, which nests its measurements, designations,
+// measurement_refs and contacts, plus optional users and calibrations
+// arrays. See source.schema.json.
+type jsonReader struct{}
+
+func (jsonReader) read(path string) (*sourceSheets, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	s := &sourceSheets{}
+	for _, key := range sortedMembers(doc) {
+		v := doc[key]
+		switch key {
+		case "users":
+			s.users, err = jsonLines(v, "user", "users")
+		case "calibrations":
+			s.calibration, err = jsonLines(v, "calibration", "calibrations")
+		case "project":
+			err = s.addJSONProject(v)
+		default:
+			err = fmt.Errorf("unknown member %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if s.project == nil {
+		return nil, fmt.Errorf("%s: there is no project", path)
+	}
+	return s, nil
+}
+
+// addJSONProject splits the project object into the project row and the rows
+// of its nested arrays.
+func (s *sourceSheets) addJSONProject(v interface{}) error {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("project must be an object")
+	}
+	fields := make(map[string]interface{}, len(obj))
+	for _, key := range sortedMembers(obj) {
+		v := obj[key]
+		var err error
+		switch key {
+		case jsonMeasurements:
+			s.measurements, err = jsonLines(v, "measurement", "project."+key)
+		case jsonDesignations:
+			s.designations, err = jsonLines(v, "designation", "project."+key)
+		case jsonMeasurementRefs:
+			s.refs, err = jsonLines(v, "measurement_ref", "project."+key)
+		case jsonContacts:
+			s.contacts, err = jsonLines(v, "contact", "project."+key)
+		default:
+			fields[key] = v
+		}
+		if err != nil {
+			return err
+		}
+	}
+	line, err := jsonLine(fields, "project", "project", 1)
+	if err != nil {
+		return err
+	}
+	s.project = append(s.project, line)
+	return nil
+}
+
+// ndjsonReader reads a source given as JSON lines, one row per line, for
+// payloads too large to hold as one document. Every line is an object with
+// a "type" of user, project, measurement, designation, measurement_ref,
+// contact or calibration and the fields of a row of that type. The rows are
+// decoded one at a time as the file is read; the row of a line is its line
+// number.
+type ndjsonReader struct{}
+
+func (ndjsonReader) read(path string) (*sourceSheets, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := &sourceSheets{}
+	sheets := map[string]*[]map[string]string{
+		"user":            &s.users,
+		"project":         &s.project,
+		"measurement":     &s.measurements,
+		"designation":     &s.designations,
+		"measurement_ref": &s.refs,
+		"contact":         &s.contacts,
+		"calibration":     &s.calibration,
+	}
+	r := &lineCounter{r: f}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	for {
+		var obj map[string]interface{}
+		err := dec.Decode(&obj)
+		if err == io.EOF {
+			break
+		}
+		// The row ends on the line the decoder stopped at: the lines read
+		// so far less those it has buffered ahead.
+		ahead, _ := ioutil.ReadAll(dec.Buffered())
+		n := r.lines - bytes.Count(ahead, []byte("\n")) + 1
+		if err == nil {
+			err = addNDJSONLine(sheets, obj, n)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", path, n, err)
+		}
+	}
+	if s.project == nil {
+		return nil, fmt.Errorf("%s: there is no line of type project", path)
+	}
+	return s, nil
+}
+
+// lineCounter counts the lines read through it.
+type lineCounter struct {
+	r     io.Reader
+	lines int
+}
+
+func (c *lineCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.lines += bytes.Count(p[:n], []byte("\n"))
+	return n, err
+}
+
+func addNDJSONLine(sheets map[string]*[]map[string]string, obj map[string]interface{}, n int) error {
+	typ, _ := obj["type"].(string)
+	lines, ok := sheets[typ]
+	if !ok {
+		return fmt.Errorf("unknown type %q", typ)
+	}
+	delete(obj, "type")
+	line, err := jsonLine(obj, typ, typ, n)
+	if err != nil {
+		return err
+	}
+	*lines = append(*lines, line)
+	return nil
+}
+
+// sortedMembers returns the member names of an object in order, so the
+// first error in a document is always the same one.
+func sortedMembers(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonLines converts an array of objects into rows of type typ.
+func jsonLines(v interface{}, typ, where string) ([]map[string]string, error) {
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be an array", where)
+	}
+	lines := make([]map[string]string, 0, len(arr))
+	for i, item := range arr {
+		line, err := jsonLine(item, typ, fmt.Sprintf("%s[%d]", where, i), i+1)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// jsonLine converts an object into a row of type typ with the values as a
+// sheet would give them: numbers as written, but without an exponent,
+// booleans as 1 and 0, null as empty. The "designation" member is the Set
+// Designation column of the sheet. Members that aren't fields of the type
+// are errors, like in the schema.
+func jsonLine(v interface{}, typ, where string, row int) (map[string]string, error) {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be an object", where)
+	}
+	fields := make(map[string]bool, len(jsonFields[typ]))
+	for _, f := range jsonFields[typ] {
+		fields[f] = true
+	}
+	line := make(map[string]string, len(obj)+1)
+	for _, key := range sortedMembers(obj) {
+		if !fields[key] {
+			return nil, fmt.Errorf("%s has unknown field %q", where, key)
+		}
+		v := obj[key]
+		var s string
+		switch v := v.(type) {
+		case nil:
+		case string:
+			s = v
+		case json.Number:
+			s = v.String()
+			if strings.ContainsAny(s, "eE") {
+				f, err := v.Float64()
+				if err != nil {
+					return nil, fmt.Errorf("%s.%s: %v", where, key, err)
+				}
+				s = strconv.FormatFloat(f, 'f', -1, 64)
+			}
+		case bool:
+			s = "0"
+			if v {
+				s = "1"
+			}
+		default:
+			return nil, fmt.Errorf("%s.%s must be a string, number, boolean or null", where, key)
+		}
+		if key == "designation" {
+			key = "Set Designation"
+		}
+		line[key] = s
+	}
+	for _, col := range dateColumns {
+		if t, err := time.Parse("2006-01-02", line[col]); err == nil {
+			line[col] = t.Format("01-02-06")
+		}
+	}
+	line[rowKey] = strconv.Itoa(row)
+	return line, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeTestSource writes a source file named name with content to a new
+// directory and returns its path.
+func writeTestSource(t *testing.T, name, content string) string {
+	dir := tempDir(t)
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJSONFieldsMatchSchema(t *testing.T) {
+	data, err := ioutil.ReadFile("source.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Definitions map[string]struct {
+			Properties           map[string]interface{} `json:"properties"`
+			AdditionalProperties *bool                  `json:"additionalProperties"`
+		} `json:"definitions"`
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+	nested := map[string]bool{jsonMeasurements: true, jsonDesignations: true, jsonMeasurementRefs: true, jsonContacts: true}
+	for typ, def := range schema.Definitions {
+		if def.AdditionalProperties == nil || *def.AdditionalProperties {
+			t.Errorf("schema definition %s allows unknown fields", typ)
+		}
+		var props []string
+		for name := range def.Properties {
+			if typ != "project" || !nested[name] {
+				props = append(props, name)
+			}
+		}
+		fields := append([]string(nil), jsonFields[typ]...)
+		sort.Strings(props)
+		sort.Strings(fields)
+		if !reflect.DeepEqual(props, fields) {
+			t.Errorf("schema definition %s has fields %v, the reader %v", typ, props, fields)
+		}
+	}
+	if len(schema.Definitions) != len(jsonFields) {
+		t.Errorf("schema has %d definitions, the reader %d row types", len(schema.Definitions), len(jsonFields))
+	}
+}
+
+func TestJSONReader(t *testing.T) {
+	path := writeTestSource(t, "source.json", `{
+		"users": [{"identifier": "a@example.com", "role": "engineer"}],
+		"project": {
+			"project_id": "P1", "area": 1.5e3, "start_date": "2024-03-01",
+			"measurements": [{"cable_id": 1, "designation": 12.5, "is_double": true, "elongation": 4.25}],
+			"measurement_refs": [{"cable_id": 1, "x": 10, "y": null}]
+		}
+	}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	s, err := jsonReader{}.read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"project_id": "P1", "area": "1500", "start_date": "03-01-24", rowKey: "1"}
+	if !reflect.DeepEqual(s.project[0], want) {
+		t.Errorf("project row %v, want %v", s.project[0], want)
+	}
+	want = map[string]string{"cable_id": "1", "Set Designation": "12.5", "is_double": "1", "elongation": "4.25", rowKey: "1"}
+	if len(s.measurements) != 1 || !reflect.DeepEqual(s.measurements[0], want) {
+		t.Errorf("measurement rows %v, want %v", s.measurements, want)
+	}
+	if len(s.refs) != 1 || s.refs[0]["x"] != "10" || s.refs[0]["y"] != "" {
+		t.Errorf("measurement_ref rows %v, want x 10 and an empty y", s.refs)
+	}
+}
+
+func TestJSONReaderUnknownField(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{`{"project": {"project_id": "P1", "colour": "red"}}`, `project has unknown field "colour"`},
+		{`{"project": {"project_id": "P1", "contacts": [{"email": "a@example.com", "phone": "1"}]}}`,
+			`project.contacts[0] has unknown field "phone"`},
+		{`{"project": {"project_id": "P1"}, "sites": []}`, `unknown member "sites"`},
+	}
+	for _, tt := range tests {
+		path := writeTestSource(t, "source.json", tt.content)
+		_, err := jsonReader{}.read(path)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.content, err, tt.err)
+		}
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
+
+func TestNDJSONReader(t *testing.T) {
+	path := writeTestSource(t, "source.ndjson", strings.Join([]string{
+		`{"type": "project", "project_id": "P1", "total_cables": 2E1}`,
+		``,
+		`{"type": "measurement", "cable_id": "C1", "elongation": 4.5}`,
+		`{"type": "measurement", "cable_id": "C2", "elongation": 1e-1}`,
+		`{"type": "designation", "designation": "12", "tolerance_min": 0}`,
+	}, "\n"))
+	defer os.RemoveAll(filepath.Dir(path))
+
+	s, err := ndjsonReader{}.read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.project) != 1 || s.project[0]["total_cables"] != "20" || s.project[0][rowKey] != "1" {
+		t.Errorf("project rows %v, want total_cables 20 on line 1", s.project)
+	}
+	if len(s.measurements) != 2 {
+		t.Fatalf("measurement rows %v, want 2", s.measurements)
+	}
+	for i, want := range []struct{ elongation, row string }{{"4.5", "3"}, {"0.1", "4"}} {
+		if m := s.measurements[i]; m["elongation"] != want.elongation || m[rowKey] != want.row {
+			t.Errorf("measurement %d is %v, want elongation %s on line %s", i, m, want.elongation, want.row)
+		}
+	}
+	if len(s.designations) != 1 || s.designations[0]["tolerance_min"] != "0" || s.designations[0][rowKey] != "5" {
+		t.Errorf("designation rows %v, want tolerance_min 0 on line 5", s.designations)
+	}
+}
+
+func TestNDJSONReaderErrorLine(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{"{\"type\": \"project\", \"project_id\": \"P1\"}\n\n{\"type\": \"contact\", \"email\": \"a@example.com\", \"fax\": 1}\n",
+			`line 3: contact has unknown field "fax"`},
+		{"{\"type\": \"project\", \"project_id\": \"P1\"}\n{\"type\": \"site\"}\n", `line 2: unknown type "site"`},
+		{"{\"type\": \"project\", \"project_id\": \"P1\", \"measurements\": []}\n", `line 1: project has unknown field "measurements"`},
+	}
+	for _, tt := range tests {
+		path := writeTestSource(t, "source.ndjson", tt.content)
+		_, err := ndjsonReader{}.read(path)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: got error %v, want %q", tt.content, err, tt.err)
+		}
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
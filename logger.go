@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel orders log entries by severity.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func parseLevel(v string) (logLevel, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(v, name) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, use one of %s", v, strings.Join(levelNames, ", "))
+}
+
+// errorLogFile is where errors are appended as text when no JSON log file is
+// configured, in the working directory.
+const errorLogFile = "log_errors.txt"
+
+// logSink is where the entries of all loggers go: the console, and either
+// the text error log or a JSON lines file.
+type logSink struct {
+	mu sync.Mutex
+
+	console      io.Writer
+	consoleLevel logLevel
+
+	// filePath is opened on the first entry that goes to the file.
+	filePath  string
+	fileLevel logLevel
+	json      bool
+	file      *os.File
+}
+
+// logger writes leveled entries with context fields. Fields are key/value
+// pairs, as in log.info("Wrote document", "path", path).
+type logger struct {
+	sink   *logSink
+	fields []interface{}
+}
+
+// applog is the logger of the program, configured by the logging flags.
+var applog = &logger{sink: &logSink{
+	console:      os.Stdout,
+	consoleLevel: levelInfo,
+	filePath:     errorLogFile,
+	fileLevel:    levelError,
+}}
+
+// with returns a logger that adds the fields to every entry.
+func (l *logger) with(kv ...interface{}) *logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	return &logger{sink: l.sink, fields: append(fields, kv...)}
+}
+
+func (l *logger) debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *logger) info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *logger) warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *logger) error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+// fatal logs an error and stops the program, with exitInterrupted when the
+// error follows an interrupt.
+func (l *logger) fatal(msg string, kv ...interface{}) {
+	l.log(levelError, msg, kv)
+	if isInterrupted() {
+		exit(exitInterrupted)
+	}
+	exit(1)
+}
+
+// logEntry is one log entry with its fields in the order they were given.
+type logEntry struct {
+	time   time.Time
+	level  logLevel
+	msg    string
+	keys   []string
+	values []interface{}
+}
+
+func (l *logger) log(level logLevel, msg string, kv []interface{}) {
+	s := l.sink
+	if level < s.consoleLevel && level < s.fileLevel {
+		return
+	}
+	e := logEntry{time: time.Now(), level: level, msg: msg}
+	all := append(append([]interface{}{}, l.fields...), kv...)
+	for i := 0; i < len(all); i += 2 {
+		key := fmt.Sprint(all[i])
+		var v interface{} = "(missing)"
+		if i+1 < len(all) {
+			v = all[i+1]
+		}
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		e.keys = append(e.keys, key)
+		e.values = append(e.values, v)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if level >= s.consoleLevel {
+		fmt.Fprintln(s.console, e.text("15:04:05"))
+	}
+	if level >= s.fileLevel && s.filePath != "" {
+		if err := s.open(); err != nil {
+			fmt.Fprintf(s.console, "Can't write log file %q: %v\n", s.filePath, err)
+			s.filePath = ""
+			return
+		}
+		if s.json {
+			s.file.Write(append(e.json(), '\n'))
+		} else {
+			fmt.Fprintln(s.file, e.text("2006/01/02 15:04:05"))
+		}
+	}
+}
+
+// text is the human-readable form of the entry: time, level, message and the
+// fields as key=value.
+func (e logEntry) text(timeLayout string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s %s", e.time.Format(timeLayout), strings.ToUpper(e.level.String()), e.msg)
+	for i, key := range e.keys {
+		v := fmt.Sprint(e.values[i])
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&b, " %s=%s", key, v)
+	}
+	return b.String()
+}
+
+// json is the entry as a JSON object. Fields that clash with time, level or
+// msg get a "field." prefix.
+func (e logEntry) json() []byte {
+	obj := map[string]interface{}{
+		"time":  e.time.UTC().Format(time.RFC3339Nano),
+		"level": e.level.String(),
+		"msg":   e.msg,
+	}
+	keys := make([]string, len(e.keys))
+	for i, key := range e.keys {
+		if _, taken := obj[key]; taken {
+			key = "field." + key
+		}
+		keys[i] = key
+		obj[key] = e.values[i]
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		// A field value that doesn't marshal is logged as text.
+		for i, key := range keys {
+			obj[key] = fmt.Sprint(e.values[i])
+		}
+		data, _ = json.Marshal(obj)
+	}
+	return data
+}
+
+func (s *logSink) open() error {
+	if s.file != nil {
+		return nil
+	}
+	f, err := os.OpenFile(s.filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	return nil
+}
+
+func (s *logSink) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
+
+// logIssues logs every validation issue as a warning or an error with the
+// sheet, row and key it is about.
+func logIssues(l *logger, issues []validationIssue) {
+	for _, issue := range issues {
+		kv := []interface{}{"sheet", issue.sheet}
+		if issue.row > 0 {
+			kv = append(kv, "row", issue.row)
+		}
+		if issue.key != "" {
+			kv = append(kv, "key", issue.key)
+		}
+		if issue.warning {
+			l.warn(issue.msg, kv...)
+		} else {
+			l.error(issue.msg, kv...)
+		}
+	}
+}
+
+// logFlags are the logging flags every command has.
+type logFlags struct {
+	level     *string
+	file      *string
+	fileLevel *string
+}
+
+func addLogFlags(fs *flag.FlagSet) *logFlags {
+	return &logFlags{
+		level:     fs.String("log-level", "info", "lowest level logged to the console: debug, info, warn or error"),
+		file:      fs.String("log-file", "", "append log entries as JSON lines to this file (default: errors as text to "+errorLogFile+")"),
+		fileLevel: fs.String("log-file-level", "debug", "lowest level written to -log-file"),
+	}
+}
+
+// apply configures applog from the parsed flags.
+func (lf *logFlags) apply() {
+	consoleLevel, err := parseLevel(*lf.level)
+	if err != nil {
+		applog.fatal(err.Error())
+	}
+	s := applog.sink
+	s.consoleLevel = consoleLevel
+	if *lf.file == "" {
+		return
+	}
+	fileLevel, err := parseLevel(*lf.fileLevel)
+	if err != nil {
+		applog.fatal(err.Error())
+	}
+	s.filePath, s.fileLevel, s.json = *lf.file, fileLevel, true
+	if err := s.open(); err != nil {
+		s.filePath, s.fileLevel, s.json = errorLogFile, levelError, false
+		applog.fatal("Can't open log file", "path", *lf.file, "err", err)
+	}
+}
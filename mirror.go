@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode"
+
+	"cloud.google.com/go/firestore"
+	firebase "firebase.google.com/go"
+	"firebase.google.com/go/db"
+	"google.golang.org/api/option"
+)
+
+// mirrorCollection is the name the mirror writes are counted and retried
+// under in the upload run.
+const mirrorCollection = "rtdb"
+
+// rtdbMirror writes the documents of the project tree to the Realtime
+// Database as well, for readers that still use it. Every document is the
+// node at its Firestore path below root, its fields are the children.
+type rtdbMirror struct {
+	client *db.Client
+	url    string
+	root   string
+}
+
+// openMirror connects to the Realtime Database at url, e.g.
+// https://{project_id}.firebaseio.com.
+func openMirror(ctx context.Context, url, root string) (*rtdbMirror, error) {
+	app, err := firebase.NewApp(ctx, &firebase.Config{DatabaseURL: url}, option.WithCredentialsFile(target.Credentials))
+	if err != nil {
+		return nil, err
+	}
+	client, err := app.Database(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &rtdbMirror{client: client, url: url, root: strings.Trim(root, "/")}, nil
+}
+
+// openRunMirror connects to the Realtime Database an upload run mirrored
+// to, nil when the run didn't mirror.
+func openRunMirror(ctx context.Context, run map[string]interface{}) (*rtdbMirror, error) {
+	url, _ := run["rtdb_url"].(string)
+	if url == "" {
+		return nil, nil
+	}
+	root, _ := run["rtdb_path"].(string)
+	return openMirror(ctx, url, root)
+}
+
+// mirrored tells the documents of the project tree from the bookkeeping of
+// the program, which isn't mirrored: the upload runs and the saved versions
+// in the history subcollections.
+func mirrored(path string) bool {
+	parts := strings.Split(path, "/")
+	if parts[0] != collection(projectCollection) {
+		return false
+	}
+	for i := 2; i < len(parts); i += 2 {
+		if parts[i] == historyCollection {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *rtdbMirror) ref(path string) *db.Ref {
+	if m.root == "" {
+		return m.client.NewRef(path)
+	}
+	return m.client.NewRef(m.root + "/" + path)
+}
+
+// rtdbKeyChars are the characters Realtime Database keys can't have.
+const rtdbKeyChars = ".$#[]/"
+
+// checkMirrorKeys reports the values of the source that become document IDs,
+// and so Realtime Database keys, but can't be keys: the project_id and the
+// ram and gauge of calibrations. Without the check the mirror write would fail
+// after the Firestore write of the document.
+func checkMirrorKeys(src *sourceData) (issues []validationIssue) {
+	bad := func(key string) bool {
+		return strings.ContainsAny(key, rtdbKeyChars) || strings.IndexFunc(key, unicode.IsControl) >= 0
+	}
+	for _, line := range src.projectlines {
+		if id := line["project_id"]; id != "" && bad(id) {
+			issues = append(issues, validationIssue{sheet: "Project", row: rowOf(line), key: id,
+				msg: "project_id can't be mirrored to the Realtime Database, it must not contain " + rtdbKeyChars})
+		}
+	}
+	for _, key := range src.curveOrder {
+		if bad(key) {
+			issues = append(issues, validationIssue{sheet: "Calibration", key: key,
+				msg: "ram and gauge can't be mirrored to the Realtime Database, they must not contain " + rtdbKeyChars})
+		}
+	}
+	return issues
+}
+
+// set writes a document. A merge write only replaces the given fields, like
+// firestore.MergeAll does.
+func (m *rtdbMirror) set(ctx context.Context, path string, data map[string]interface{}, merge bool) error {
+	v := rtdbValue(data).(map[string]interface{})
+	if merge {
+		if len(v) == 0 {
+			return nil
+		}
+		return m.ref(path).Update(ctx, v)
+	}
+	return m.ref(path).Set(ctx, v)
+}
+
+// restore puts back the fields a document had before a run. The node isn't
+// replaced, since it also holds the nodes of the document's subcollections:
+// the fields of before are updated and those only after has are removed.
+func (m *rtdbMirror) restore(ctx context.Context, path string, before, after map[string]interface{}) error {
+	v := make(map[string]interface{}, len(before))
+	if before != nil {
+		v = rtdbValue(before).(map[string]interface{})
+	}
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			v[k] = nil
+		}
+	}
+	if len(v) == 0 {
+		return nil
+	}
+	return m.ref(path).Update(ctx, v)
+}
+
+func (m *rtdbMirror) delete(ctx context.Context, path string) error {
+	return m.ref(path).Delete(ctx)
+}
+
+// rtdbValue converts a Firestore value to what the Realtime Database stores:
+// times become milliseconds since the epoch, like its server timestamps, and
+// document references their path.
+func rtdbValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Time:
+		return v.UnixNano() / int64(time.Millisecond)
+	case *firestore.DocumentRef:
+		return relativePath(v)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			out[k] = rtdbValue(x)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, x := range v {
+			out[i] = rtdbValue(x)
+		}
+		return out
+	}
+	return v
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	firebase "firebase.google.com/go"
+	"firebase.google.com/go/messaging"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// deviceTokensField is the field of a users document with the FCM
+// registration tokens of the user's devices.
+const deviceTokensField = "fcm_tokens"
+
+// notifyCollections are the subcollections a notification counts the
+// written documents of, in the order they are named.
+var notifyCollections = []string{"measurements", "designations", "measurement-refs", "contacts", "calibrations"}
+
+// messenger sends the notifications of an upload, so a local file can stand
+// in for Firebase Cloud Messaging.
+type messenger interface {
+	// send delivers a message, or only validates it when dryRun is set,
+	// and returns the ID of the message.
+	send(ctx context.Context, msg *messaging.Message, dryRun bool) (string, error)
+}
+
+type fcmMessenger struct {
+	client *messaging.Client
+}
+
+func (m fcmMessenger) send(ctx context.Context, msg *messaging.Message, dryRun bool) (string, error) {
+	if dryRun {
+		return m.client.SendDryRun(ctx, msg)
+	}
+	return m.client.Send(ctx, msg)
+}
+
+// fileMessenger appends every message as a JSON line to a file instead of
+// sending it.
+type fileMessenger struct {
+	path string
+}
+
+func (m fileMessenger) send(ctx context.Context, msg *messaging.Message, dryRun bool) (string, error) {
+	data, err := json.Marshal(struct {
+		DryRun  bool               `json:"dry_run"`
+		Message *messaging.Message `json:"message"`
+	}{dryRun, msg})
+	if err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return "", err
+	}
+	return "local", f.Close()
+}
+
+// notifyFlags are the notification flags of the upload.
+type notifyFlags struct {
+	mode  *string
+	topic *string
+	file  *string
+}
+
+func addNotifyFlags(fs *flag.FlagSet) *notifyFlags {
+	return &notifyFlags{
+		mode:  fs.String("notify", "", "notify about every uploaded project: topic (the project's topic) or devices (the devices of its engineer_id and field_tech_id)"),
+		topic: fs.String("notify-topic", "project-{project_id}", "topic of a project's notification, {project_id} is replaced"),
+		file:  fs.String("notify-file", "", "write the notifications as JSON lines to this file instead of sending them"),
+	}
+}
+
+// check reports an unknown -notify mode before anything is uploaded.
+func (nf *notifyFlags) check() error {
+	switch *nf.mode {
+	case "", "topic", "devices":
+		return nil
+	}
+	return fmt.Errorf("unknown -notify %q, use topic or devices", *nf.mode)
+}
+
+// open returns the notifier of the flags, nil when notifications are off. In
+// dry-run mode the messages are only validated.
+func (nf *notifyFlags) open(ctx context.Context, app *firebase.App, client *firestore.Client, dryRun bool) (*notifier, error) {
+	if *nf.mode == "" {
+		return nil, nil
+	}
+	n := &notifier{mode: *nf.mode, topic: *nf.topic, dryRun: dryRun,
+		tokens: func(ctx context.Context, uids ...string) ([]string, error) {
+			return deviceTokens(ctx, client, uids...)
+		}}
+	if *nf.file != "" {
+		n.out = fileMessenger{*nf.file}
+		return n, nil
+	}
+	m, err := app.Messaging(ctx)
+	if err != nil {
+		return nil, err
+	}
+	n.out = fcmMessenger{m}
+	return n, nil
+}
+
+// notifier tells the members of uploaded projects what changed.
+type notifier struct {
+	mode  string
+	topic string
+	// tokens looks up the device tokens of users, see deviceTokens.
+	tokens func(ctx context.Context, uids ...string) ([]string, error)
+	out    messenger
+	dryRun bool
+}
+
+// notify sends the notification about one project of the upload, written
+// counts the written documents by collection. Failures are only logged, the
+// project is uploaded by then.
+func (n *notifier) notify(ctx context.Context, line map[string]string, change statusChange, written map[string]int, runID string) {
+	id := line["project_id"]
+	log := applog.with("project", id, "notify", n.mode)
+	msg := projectMessage(line, change, written, runID)
+	var recipients []messaging.Message
+	if n.mode == "topic" {
+		m := *msg
+		m.Topic = strings.Replace(n.topic, "{project_id}", id, -1)
+		recipients = append(recipients, m)
+	} else {
+		tokens, err := n.tokens(ctx, line["engineer_id"], line["field_tech_id"])
+		if err != nil {
+			log.warn("Can't read device tokens, no notification sent", "err", err)
+			return
+		}
+		for _, token := range tokens {
+			m := *msg
+			m.Token = token
+			recipients = append(recipients, m)
+		}
+	}
+	if len(recipients) == 0 {
+		log.info("No devices to notify")
+	}
+	for i := range recipients {
+		m := &recipients[i]
+		msgID, err := n.out.send(ctx, m, n.dryRun)
+		to := m.Topic
+		if to == "" {
+			to = "device " + m.Token
+			if len(m.Token) > 12 {
+				to = "device " + m.Token[:12] + "..."
+			}
+		}
+		switch {
+		case err != nil && messaging.IsRegistrationTokenNotRegistered(err):
+			log.warn("Device is no longer registered", "to", to)
+		case err != nil:
+			log.warn("Can't send notification", "to", to, "err", err)
+		case n.dryRun:
+			log.info("Notification validated", "to", to)
+		default:
+			log.info("Notification sent", "to", to, "id", msgID)
+		}
+	}
+}
+
+// projectMessage describes the upload of a project: its status change and
+// the documents written to its subcollections.
+func projectMessage(line map[string]string, change statusChange, written map[string]int, runID string) *messaging.Message {
+	name := line["name"]
+	if name == "" {
+		name = line["project_id"]
+	}
+	var body []string
+	switch {
+	case !change.exists:
+		body = append(body, fmt.Sprintf("New project, status %s.", change.to))
+	case change.from != change.to:
+		body = append(body, fmt.Sprintf("Status changed from %s to %s.", change.from, change.to))
+	}
+	var counts []string
+	for _, coll := range notifyCollections {
+		if written[coll] != 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", written[coll], coll))
+		}
+	}
+	if len(counts) != 0 {
+		body = append(body, "Updated "+strings.Join(counts, ", ")+".")
+	}
+	data := map[string]string{"project_id": line["project_id"], "status": change.to.String()}
+	if runID != "" {
+		data["run_id"] = runID
+	}
+	return &messaging.Message{
+		Notification: &messaging.Notification{
+			Title: fmt.Sprintf("Project %s uploaded", name),
+			Body:  strings.Join(body, " "),
+		},
+		Data: data,
+	}
+}
+
+// deviceTokens returns the registration tokens of the users, skipping empty
+// and unknown user IDs.
+func deviceTokens(ctx context.Context, client *firestore.Client, uids ...string) ([]string, error) {
+	var tokens []string
+	seen := make(map[string]bool)
+	for _, uid := range uids {
+		if uid == "" {
+			continue
+		}
+		snap, err := client.Collection(collection(usersCollection)).Doc(uid).Get(ctx)
+		if status.Code(err) == codes.NotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		list, _ := snap.Data()[deviceTokensField].([]interface{})
+		for _, v := range list {
+			if token, ok := v.(string); ok && token != "" && !seen[token] {
+				seen[token] = true
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens, nil
+}
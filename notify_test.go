@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"firebase.google.com/go/messaging"
+)
+
+// recordingMessenger keeps the messages instead of sending them.
+type recordingMessenger struct {
+	sent   []*messaging.Message
+	dryRun []bool
+}
+
+func (m *recordingMessenger) send(ctx context.Context, msg *messaging.Message, dryRun bool) (string, error) {
+	m.sent = append(m.sent, msg)
+	m.dryRun = append(m.dryRun, dryRun)
+	return "id", nil
+}
+
+func TestProjectMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    map[string]string
+		change  statusChange
+		written map[string]int
+		runID   string
+		title   string
+		body    string
+		data    map[string]string
+	}{
+		{
+			name:    "new project",
+			line:    map[string]string{"project_id": "P1", "name": "Tower A"},
+			change:  statusChange{to: statusDraft},
+			written: map[string]int{"measurements": 3, "contacts": 1, "project": 1},
+			runID:   "run1",
+			title:   "Project Tower A uploaded",
+			body:    "New project, status draft. Updated 3 measurements, 1 contacts.",
+			data:    map[string]string{"project_id": "P1", "status": "draft", "run_id": "run1"},
+		},
+		{
+			name:    "status change",
+			line:    map[string]string{"project_id": "P2"},
+			change:  statusChange{exists: true, from: statusFieldStarted, to: statusFieldSubmitted},
+			written: map[string]int{"designations": 2, "calibrations": 1},
+			title:   "Project P2 uploaded",
+			body:    "Status changed from field_started to field_submitted. Updated 2 designations, 1 calibrations.",
+			data:    map[string]string{"project_id": "P2", "status": "field_submitted"},
+		},
+		{
+			name:    "same status",
+			line:    map[string]string{"project_id": "P3", "name": "Garage"},
+			change:  statusChange{exists: true, from: statusApproved, to: statusApproved},
+			written: map[string]int{"measurement-refs": 4},
+			runID:   "run3",
+			title:   "Project Garage uploaded",
+			body:    "Updated 4 measurement-refs.",
+			data:    map[string]string{"project_id": "P3", "status": "approved", "run_id": "run3"},
+		},
+	}
+	for _, tt := range tests {
+		msg := projectMessage(tt.line, tt.change, tt.written, tt.runID)
+		if msg.Notification.Title != tt.title {
+			t.Errorf("%s: title %q, want %q", tt.name, msg.Notification.Title, tt.title)
+		}
+		if msg.Notification.Body != tt.body {
+			t.Errorf("%s: body %q, want %q", tt.name, msg.Notification.Body, tt.body)
+		}
+		if !reflect.DeepEqual(msg.Data, tt.data) {
+			t.Errorf("%s: data %v, want %v", tt.name, msg.Data, tt.data)
+		}
+	}
+}
+
+func TestNotifyTopic(t *testing.T) {
+	out := &recordingMessenger{}
+	n := &notifier{mode: "topic", topic: "site-{project_id}-news", out: out, dryRun: true}
+	line := map[string]string{"project_id": "P1", "name": "Tower A"}
+	n.notify(context.Background(), line, statusChange{to: statusDraft}, map[string]int{"measurements": 2}, "run1")
+
+	if len(out.sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(out.sent))
+	}
+	if msg := out.sent[0]; msg.Topic != "site-P1-news" || msg.Token != "" {
+		t.Errorf("sent to topic %q token %q, want topic site-P1-news", msg.Topic, msg.Token)
+	}
+	if !out.dryRun[0] {
+		t.Error("message was not sent as a dry run")
+	}
+}
+
+func TestNotifyDevices(t *testing.T) {
+	out := &recordingMessenger{}
+	var asked []string
+	n := &notifier{mode: "devices", out: out,
+		tokens: func(ctx context.Context, uids ...string) ([]string, error) {
+			asked = uids
+			return []string{"token-a", "token-b"}, nil
+		}}
+	line := map[string]string{"project_id": "P1", "engineer_id": "eng", "field_tech_id": "tech"}
+	n.notify(context.Background(), line, statusChange{to: statusDraft}, nil, "run1")
+
+	if !reflect.DeepEqual(asked, []string{"eng", "tech"}) {
+		t.Errorf("looked up tokens of %v, want the engineer and the field tech", asked)
+	}
+	if len(out.sent) != 2 {
+		t.Fatalf("sent %d messages, want one per device", len(out.sent))
+	}
+	for i, token := range []string{"token-a", "token-b"} {
+		msg := out.sent[i]
+		if msg.Token != token || msg.Topic != "" {
+			t.Errorf("message %d sent to token %q topic %q, want token %q", i, msg.Token, msg.Topic, token)
+		}
+		if msg.Notification.Title != "Project P1 uploaded" || msg.Data["run_id"] != "run1" {
+			t.Errorf("message %d is %+v, want the project's message", i, msg)
+		}
+		if out.dryRun[i] {
+			t.Errorf("message %d was sent as a dry run", i)
+		}
+	}
+}
+
+func TestNotifyDevicesWithoutTokens(t *testing.T) {
+	out := &recordingMessenger{}
+	line := map[string]string{"project_id": "P1", "engineer_id": "eng"}
+	for _, tokens := range []func(ctx context.Context, uids ...string) ([]string, error){
+		func(ctx context.Context, uids ...string) ([]string, error) { return nil, nil },
+		func(ctx context.Context, uids ...string) ([]string, error) { return nil, errors.New("unavailable") },
+	} {
+		n := &notifier{mode: "devices", out: out, tokens: tokens}
+		n.notify(context.Background(), line, statusChange{to: statusDraft}, nil, "run1")
+	}
+	if len(out.sent) != 0 {
+		t.Errorf("sent %d messages without device tokens", len(out.sent))
+	}
+}
+
+func TestFileMessenger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "firestoreUpload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notify.jsonl")
+
+	n := &notifier{mode: "topic", topic: "project-{project_id}", out: fileMessenger{path}}
+	for _, id := range []string{"P1", "P2"} {
+		n.notify(context.Background(), map[string]string{"project_id": id}, statusChange{to: statusDraft}, nil, "run1")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("file has %d lines, want one per message:\n%s", len(lines), data)
+	}
+	for i, id := range []string{"P1", "P2"} {
+		var entry struct {
+			DryRun  bool `json:"dry_run"`
+			Message struct {
+				Topic string            `json:"topic"`
+				Data  map[string]string `json:"data"`
+			} `json:"message"`
+		}
+		if err := json.Unmarshal([]byte(lines[i]), &entry); err != nil {
+			t.Fatalf("line %d: %v", i+1, err)
+		}
+		if entry.DryRun || entry.Message.Topic != "project-"+id || entry.Message.Data["project_id"] != id {
+			t.Errorf("line %d is %s, want the message of %s", i+1, lines[i], id)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// rateLimiter spaces out calls to wait so they don't exceed a rate per
+// second. A nil limiter doesn't limit.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait blocks until the caller may go on.
+func (r *rateLimiter) wait() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	at := r.next
+	r.next = r.next.Add(r.interval)
+	r.mu.Unlock()
+	time.Sleep(at.Sub(now))
+}
+
+// queuedWrite is a document write handed to the write workers. seq is the
+// order it was queued in, fields the log context of the write.
+type queuedWrite struct {
+	seq    int
+	ref    *firestore.DocumentRef
+	data   map[string]interface{}
+	opts   []firestore.SetOption
+	fields []interface{}
+}
+
+// writeFailure is a queued write that failed.
+type writeFailure struct {
+	write queuedWrite
+	err   error
+}
+
+// writePool runs the queued writes of an uploader on a fixed number of
+// workers. After a write fails no further writes are started, and of all
+// failed writes the one queued first is reported, so the same bad row gives
+// the same error however the writes were scheduled.
+type writePool struct {
+	up      *uploader
+	writes  chan queuedWrite
+	pending sync.WaitGroup
+
+	mu      sync.Mutex
+	seq     int
+	failure *writeFailure
+	stopped bool
+	closed  bool
+}
+
+func newWritePool(up *uploader, workers int) *writePool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &writePool{up: up, writes: make(chan queuedWrite, 2*workers)}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *writePool) work() {
+	for w := range p.writes {
+		if !p.failed() && !isInterrupted() {
+			if err := p.up.set(w.ref, w.data, w.opts...); err != nil {
+				p.mu.Lock()
+				if p.failure == nil || w.seq < p.failure.write.seq {
+					p.failure = &writeFailure{w, err}
+				}
+				p.mu.Unlock()
+			}
+		}
+		p.pending.Done()
+	}
+}
+
+func (p *writePool) failed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.failure != nil || p.stopped
+}
+
+// wait blocks until every queued write is done and returns the failure, if
+// any.
+func (p *writePool) wait() *writeFailure {
+	p.pending.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.failure
+}
+
+// abort drops the writes that haven't started and waits for the others.
+func (p *writePool) abort() {
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+	p.pending.Wait()
+}
+
+func (p *writePool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.writes)
+	}
+}
+
+// queue hands a document write to the write workers. Use set instead when
+// later writes depend on the document, like a project and its
+// subcollections. The fields are the log context reported when the write
+// fails, see flush.
+func (u *uploader) queue(ref *firestore.DocumentRef, data map[string]interface{}, fields []interface{}, opts ...firestore.SetOption) {
+	p := u.pool
+	p.mu.Lock()
+	if p.failure != nil || p.stopped || isInterrupted() {
+		// flush reports the failure, the rest of the upload is skipped.
+		p.mu.Unlock()
+		return
+	}
+	p.seq++
+	w := queuedWrite{seq: p.seq, ref: ref, data: data, opts: opts, fields: fields}
+	p.mu.Unlock()
+	p.pending.Add(1)
+	p.writes <- w
+}
+
+// flush waits for the queued writes. When one failed the run stops with the
+// failed write queued first.
+func (u *uploader) flush() {
+	f := u.pool.wait()
+	if isInterrupted() {
+		u.interrupt()
+	}
+	if f == nil {
+		return
+	}
+	kv := append(append([]interface{}{}, f.write.fields...), "path", relativePath(f.write.ref), "err", f.err)
+	u.fail("Can't write document", kv...)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	firebase "firebase.google.com/go"
+)
+
+// uploadPlan is what an upload of a source would do, worked out from the
+// source and the current state of Firestore and Auth without writing
+// anything. issues are the status changes the workflow doesn't allow.
+type uploadPlan struct {
+	projects  []plannedProject
+	users     int
+	newUsers  []string
+	documents map[string]int
+	issues    []validationIssue
+}
+
+// plannedProject is a project document of the plan. documents are the
+// documents written below it, by collection.
+type plannedProject struct {
+	id        string
+	change    statusChange
+	documents map[string]int
+}
+
+// makePlan reads the projects and accounts the source touches. Accounts are
+// only looked up when the source has users.
+func makePlan(ctx context.Context, app *firebase.App, client *firestore.Client, src *sourceData) (*uploadPlan, error) {
+	changes, issues, err := planStatusChanges(ctx, client, src.projectlines)
+	if err != nil {
+		return nil, fmt.Errorf("reading project status: %v", err)
+	}
+	p := &uploadPlan{users: len(src.userlines), documents: make(map[string]int), issues: issues}
+	for _, line := range src.projectlines {
+		if id := line["project_id"]; id != "" {
+			docs := map[string]int{"project": 1, "calibrations": len(src.curveOrder)}
+			p.projects = append(p.projects, plannedProject{id, changes[id], docs})
+		}
+	}
+	// The Manipulate rows and contacts go below the project of the source,
+	// the last one like the upload does.
+	children := map[string]int{
+		"measurements":     len(src.cables),
+		"designations":     len(src.designations),
+		"measurement-refs": len(src.measurementrefslines),
+	}
+	for _, line := range src.contactlines {
+		if line["email"] != "" {
+			children["contacts"]++
+		}
+	}
+	if n := len(p.projects); n != 0 {
+		for coll, count := range children {
+			p.projects[n-1].documents[coll] += count
+		}
+	}
+	for _, pr := range p.projects {
+		for coll, count := range pr.documents {
+			p.documents[coll] += count
+		}
+	}
+
+	if len(src.userlines) == 0 {
+		return p, nil
+	}
+	authClient, err := app.Auth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("opening Auth client: %v", err)
+	}
+	for _, line := range src.userlines {
+		if _, err := authClient.GetUserByEmail(ctx, line["identifier"]); err != nil {
+			if !strings.Contains(err.Error(), "cannot find user from email") {
+				return nil, fmt.Errorf("looking up user %q: %v", line["identifier"], err)
+			}
+			p.newUsers = append(p.newUsers, line["identifier"])
+		}
+	}
+	return p, nil
+}
+
+func (p *uploadPlan) String() string {
+	s := "Upload plan:"
+	for _, pr := range p.projects {
+		action := "create"
+		if pr.change.exists {
+			action = "update"
+		}
+		s += fmt.Sprintf("\n  project %s: %s, status %s", pr.id, action, pr.change.to)
+		if pr.change.exists && pr.change.from != pr.change.to {
+			s += fmt.Sprintf(" (now %s)", pr.change.from)
+		}
+	}
+	if p.users != 0 {
+		s += fmt.Sprintf("\n  users: %d rows, %d new accounts", p.users, len(p.newUsers))
+		for _, email := range p.newUsers {
+			s += "\n    " + email
+		}
+	}
+	colls := make([]string, 0, len(p.documents))
+	for coll := range p.documents {
+		colls = append(colls, coll)
+	}
+	sort.Strings(colls)
+	for _, coll := range colls {
+		s += fmt.Sprintf("\n  %-18s %4d documents", coll, p.documents[coll])
+	}
+	return s
+}
+
+// MarshalJSON gives the plan to the API of the serve command.
+func (p *uploadPlan) MarshalJSON() ([]byte, error) {
+	type project struct {
+		ID     string `json:"project_id"`
+		Exists bool   `json:"exists"`
+		From   string `json:"status_from,omitempty"`
+		To     string `json:"status_to"`
+	}
+	projects := make([]project, 0, len(p.projects))
+	for _, pr := range p.projects {
+		pj := project{ID: pr.id, Exists: pr.change.exists, To: pr.change.to.String()}
+		if pr.change.exists {
+			pj.From = pr.change.from.String()
+		}
+		projects = append(projects, pj)
+	}
+	return json.Marshal(struct {
+		Projects  []project         `json:"projects"`
+		Users     int               `json:"users"`
+		NewUsers  []string          `json:"new_users"`
+		Documents map[string]int    `json:"documents"`
+		Issues    []validationIssue `json:"issues"`
+	}{projects, p.users, p.newUsers, p.documents, p.issues})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	firebase "firebase.google.com/go"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// configFile is the default file with the profiles, in the run directory.
+const configFile = "firestoreUpload.json"
+
+// profileEnv names the profile used when there is no -profile flag.
+const profileEnv = "FIRESTOREUPLOAD_PROFILE"
+
+// The top-level collections of the program. They get the collection prefix
+// of the profile, see collection.
+const (
+	projectCollection = "project"
+	usersCollection   = "users"
+	uploadsCollection = "uploads"
+)
+
+// profile is a Firebase project the program can work on, as named in the
+// config file:
+//
+//	{
+//	  "default": "dev",
+//	  "profiles": {
+//	    "dev":  {"credentials": "keys/dev.json", "collection_prefix": "dev_",
+//	             "emulators": {"firestore": "localhost:8080"}},
+//	    "prod": {"credentials": "keys/prod.json", "project_id": "acme-prod", "production": true}
+//	  }
+//	}
+type profile struct {
+	name string
+
+	Credentials      string `json:"credentials"`
+	ProjectID        string `json:"project_id"`
+	CollectionPrefix string `json:"collection_prefix"`
+	Production       bool   `json:"production"`
+	Emulators        struct {
+		Firestore string `json:"firestore"`
+	} `json:"emulators"`
+}
+
+// profileConfig is the content of the config file.
+type profileConfig struct {
+	Default  string              `json:"default"`
+	Profiles map[string]*profile `json:"profiles"`
+}
+
+// target is the profile of the command. Without a config file it is the
+// service account key of the run directory, as before there were profiles.
+var target = &profile{Credentials: serviceAccountFile}
+
+// collection returns the name of a top-level collection in the target.
+func collection(name string) string {
+	return target.CollectionPrefix + name
+}
+
+// projectID is the project of the profile, from the credentials when the
+// profile doesn't name it.
+func (p *profile) projectID() string {
+	if p.ProjectID != "" {
+		return p.ProjectID
+	}
+	return readServiceAccountKey(p.Credentials).ProjectID
+}
+
+// readProfiles reads the config file. Relative credentials paths are
+// relative to the file.
+func readProfiles(path string) (*profileConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var conf profileConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&conf); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for name, p := range conf.Profiles {
+		if p == nil {
+			return nil, fmt.Errorf("%s: profile %q is empty", path, name)
+		}
+		p.name = name
+		if p.Credentials != "" && !filepath.IsAbs(p.Credentials) {
+			p.Credentials = filepath.Join(filepath.Dir(path), p.Credentials)
+		}
+		if p.Credentials == "" && p.Emulators.Firestore == "" {
+			return nil, fmt.Errorf("%s: profile %q needs credentials", path, name)
+		}
+		if p.Credentials == "" && p.ProjectID == "" {
+			return nil, fmt.Errorf("%s: profile %q needs a project_id", path, name)
+		}
+	}
+	return &conf, nil
+}
+
+// profileFlags choose the profile of a command. Commands that write also
+// have -confirm.
+type profileFlags struct {
+	name      *string
+	config    *string
+	confirmID *string
+}
+
+func addProfileFlags(fs *flag.FlagSet, writes bool) *profileFlags {
+	pf := &profileFlags{
+		name:   fs.String("profile", os.Getenv(profileEnv), "profile of the config file to work on (default: $"+profileEnv+", then the config's default)"),
+		config: fs.String("config", configFile, "config file with the profiles"),
+	}
+	if writes {
+		pf.confirmID = fs.String("confirm", "", "project ID of a production target, to write to it without being asked")
+	}
+	return pf
+}
+
+// load makes the chosen profile the target. Without a config file the
+// service account key of the run directory stays the target, unless a
+// profile was asked for.
+func (pf *profileFlags) load() {
+	conf, err := readProfiles(*pf.config)
+	if os.IsNotExist(err) && *pf.name == "" && *pf.config == configFile {
+		return
+	}
+	if err != nil {
+		applog.fatal("Can't read the profiles", "err", err)
+	}
+	name := *pf.name
+	if name == "" {
+		name = conf.Default
+	}
+	if name == "" {
+		applog.fatal("Choose a profile with -profile", "profiles", strings.Join(profileNames(conf), ", "))
+	}
+	p, ok := conf.Profiles[name]
+	if !ok {
+		applog.fatal("Unknown profile", "profile", name, "profiles", strings.Join(profileNames(conf), ", "))
+	}
+	// The credentials decide where Auth, Storage, Cloud Messaging and the
+	// Realtime Database go, also next to the Firestore emulator, so a
+	// different project_id would make the banner name the wrong project.
+	if key := readServiceAccountKey(p.Credentials).ProjectID; p.ProjectID != "" && key != "" && key != p.ProjectID {
+		applog.fatal("The project_id of the profile is not the project of its credentials, nothing was done",
+			"profile", name, "project_id", p.ProjectID, "credentials", p.Credentials, "credentials_project", key)
+	}
+	target = p
+	applog.debug("Using profile", "profile", name, "project", target.projectID())
+}
+
+func profileNames(conf *profileConfig) []string {
+	names := make([]string, 0, len(conf.Profiles))
+	for name := range conf.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// args are the flags that make an upload run by serve or watch work on the
+// same target, confirmed already.
+func (pf *profileFlags) args() []string {
+	if target.name == "" {
+		return nil
+	}
+	args := []string{"-config", *pf.config, "-profile", target.name}
+	if target.Production {
+		args = append(args, "-confirm", target.projectID())
+	}
+	return args
+}
+
+// confirm shows the target before a command writes to it. Writing to a
+// production target needs its project ID, typed in or given with -confirm.
+func (pf *profileFlags) confirm(what string) {
+	id := target.projectID()
+	fmt.Fprintln(os.Stderr, targetBanner(what, id))
+	if !target.Production || *pf.confirmID == id {
+		return
+	}
+	if *pf.confirmID != "" {
+		applog.fatal("-confirm doesn't match the production project, nothing was written", "confirm", *pf.confirmID, "project", id)
+	}
+	if !stdinIsTerminal() {
+		applog.fatal("The target is production, run with -confirm "+id+" to write to it", "project", id)
+	}
+	fmt.Fprintf(os.Stderr, "Type the project ID %q to continue: ", id)
+	line, ok := readLine()
+	if !ok {
+		applog.warn("Interrupted, nothing was written", "project", id)
+		exit(exitInterrupted)
+	}
+	if strings.TrimSpace(line) != id {
+		applog.fatal("Not confirmed, nothing was written", "project", id)
+	}
+}
+
+// targetBanner tells where the writes of a command go.
+func targetBanner(what, id string) string {
+	name := target.name
+	if name == "" {
+		name = "(no profile)"
+	}
+	lines := []string{
+		fmt.Sprintf("%s  %s", what, strings.ToUpper(name)),
+		fmt.Sprintf("project      %s", id),
+		fmt.Sprintf("credentials  %s", target.Credentials),
+	}
+	if target.CollectionPrefix != "" {
+		lines = append(lines, fmt.Sprintf("collections  %s*", target.CollectionPrefix))
+	}
+	if target.Emulators.Firestore != "" {
+		lines = append(lines, fmt.Sprintf("firestore    emulator at %s", target.Emulators.Firestore))
+		if target.Credentials != "" {
+			lines = append(lines, fmt.Sprintf("others       project %s, no emulator", id))
+		}
+	}
+	if target.Production {
+		lines = append(lines, "!!! PRODUCTION !!!")
+	}
+	rule := strings.Repeat("=", 60)
+	return rule + "\n  " + strings.Join(lines, "\n  ") + "\n" + rule
+}
+
+// openApp initializes the Firebase app of the target. A profile that only
+// uses the Firestore emulator needs no credentials.
+func openApp(ctx context.Context) *firebase.App {
+	opt := option.WithCredentialsFile(target.Credentials)
+	if target.Credentials == "" {
+		opt = option.WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "owner"}))
+	}
+	var conf *firebase.Config
+	if target.ProjectID != "" {
+		conf = &firebase.Config{ProjectID: target.ProjectID}
+	}
+	app, err := firebase.NewApp(ctx, conf, opt)
+	if err != nil {
+		applog.fatal("Can't initialize the Firebase app", "err", err)
+	}
+	return app
+}
+
+// openFirestore opens the Firestore of the target, or its emulator.
+func openFirestore(ctx context.Context, app *firebase.App) (*firestore.Client, error) {
+	if target.Emulators.Firestore == "" {
+		return app.Firestore(ctx)
+	}
+	conn, err := grpc.Dial(target.Emulators.Firestore, grpc.WithInsecure(), grpc.WithPerRPCCredentials(emulatorOwner{}))
+	if err != nil {
+		return nil, err
+	}
+	return firestore.NewClient(ctx, target.projectID(), option.WithGRPCConn(conn))
+}
+
+// emulatorOwner signs in to the Firestore emulator as the owner, so
+// security rules don't apply, like for the Admin SDK.
+type emulatorOwner struct{}
+
+func (emulatorOwner) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer owner"}, nil
+}
+
+func (emulatorOwner) RequireTransportSecurity() bool {
+	return false
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// markerRadius is the radius of a measurement-ref marker on the map in
+// pixels. Markers closer than two radii overlap.
+const markerRadius = 8
+
+var (
+	markerFill    = color.RGBA{0xD3, 0x2F, 0x2F, 0xFF}
+	markerOutline = color.RGBA{0xFF, 0xFF, 0xFF, 0xFF}
+	labelText     = color.RGBA{0x00, 0x00, 0x00, 0xFF}
+	labelBack     = color.NRGBA{0xFF, 0xFF, 0xFF, 0xD0}
+)
+
+// mapMarker is a measurement-ref as drawn on the map image.
+type mapMarker struct {
+	label string
+	row   int
+	x, y  int
+}
+
+// markerPosition parses the pixel coordinates of a measurement-ref, decimals
+// are rounded to whole pixels. ok is false when the ref has no coordinates.
+func markerPosition(line map[string]string) (x, y int, ok bool, err error) {
+	if strings.TrimSpace(line["x"]) == "" && strings.TrimSpace(line["y"]) == "" {
+		return 0, 0, false, nil
+	}
+	var xy [2]int
+	for i, col := range []string{"x", "y"} {
+		v, err := strconv.ParseFloat(strings.TrimSpace(line[col]), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return 0, 0, false, fmt.Errorf("%s must be a number of pixels, got %q", col, line[col])
+		}
+		xy[i] = int(math.Round(v))
+	}
+	return xy[0], xy[1], true, nil
+}
+
+// mapMarkers returns the markers of the refs with coordinates. Refs without
+// coordinates are only warned about, invalid coordinates are errors; neither
+// is drawn.
+func mapMarkers(refs []map[string]string) (markers []mapMarker, issues []validationIssue) {
+	markers = make([]mapMarker, 0, len(refs))
+	for _, line := range refs {
+		parts := []string{line["cable_id"], line["end_id"], line["suffix"]}
+		label := strings.Trim(strings.Join(parts, "/"), "/")
+		x, y, ok, err := markerPosition(line)
+		switch {
+		case err != nil:
+			issues = append(issues, validationIssue{sheet: "Manipulate", row: rowOf(line), key: label, msg: err.Error()})
+		case !ok:
+			issues = append(issues, validationIssue{sheet: "Manipulate", row: rowOf(line), key: label, warning: true,
+				msg: "measurement-ref has no x and y, it has no marker on the map"})
+		default:
+			markers = append(markers, mapMarker{label, rowOf(line), x, y})
+		}
+	}
+	return markers, issues
+}
+
+// projectMapImage returns the local map image of the first project that has
+// one. A source that may only reference images by URL has none.
+func projectMapImage(src *sourceData) (projectID, path string, ok bool) {
+	if src.imageURLsOnly {
+		return "", "", false
+	}
+	for _, line := range src.projectlines {
+		if line["project_id"] == "" {
+			continue
+		}
+		if path, ok := localImagePath(line["map_image"], src.dir()); ok && fileExists(path) {
+			return line["project_id"], path, true
+		}
+	}
+	return "", "", false
+}
+
+// checkMarkers reports measurement-refs with invalid coordinates and those
+// outside of the map image, and warns about markers that overlap. The map
+// checks need the map image as a local file. The upload stores the map
+// upright at its own size, so its upright size is the size in storage.
+func checkMarkers(src *sourceData) (issues []validationIssue) {
+	markers, issues := mapMarkers(src.measurementrefslines)
+	_, path, ok := projectMapImage(src)
+	if !ok {
+		return issues
+	}
+	w, h, err := pictureSize(path)
+	if err != nil {
+		// The image checks already report unusable pictures.
+		return issues
+	}
+
+	for i, m := range markers {
+		if m.x < 0 || m.y < 0 || m.x >= w || m.y >= h {
+			issues = append(issues, validationIssue{sheet: "Manipulate", row: m.row, key: m.label,
+				msg: fmt.Sprintf("marker at %d,%d is outside of the %dx%d map image", m.x, m.y, w, h)})
+			continue
+		}
+		for _, o := range markers[:i] {
+			if math.Hypot(float64(m.x-o.x), float64(m.y-o.y)) < 2*markerRadius {
+				issues = append(issues, validationIssue{sheet: "Manipulate", row: m.row, key: m.label, warning: true,
+					msg: fmt.Sprintf("marker at %d,%d overlaps %s at %d,%d", m.x, m.y, o.label, o.x, o.y)})
+			}
+		}
+	}
+	return issues
+}
+
+// renderMap draws every marker with its label onto the map image.
+func renderMap(img *image.RGBA, markers []mapMarker) {
+	for _, m := range markers {
+		fillCircle(img, m.x, m.y, markerRadius, markerOutline)
+		fillCircle(img, m.x, m.y, markerRadius-2, markerFill)
+
+		const scale = 2
+		tw, th := textWidth(m.label)*scale, glyphHeight*scale
+		lx, ly := m.x+markerRadius+2, m.y-th/2
+		box := image.Rect(lx-2, ly-2, lx+tw+2, ly+th+2)
+		draw.Draw(img, box, image.NewUniform(labelBack), image.Point{}, draw.Over)
+		drawText(img, lx, ly, m.label, scale, labelText)
+	}
+}
+
+func fillCircle(img *image.RGBA, cx, cy, r int, c color.RGBA) {
+	for y := -r; y <= r; y++ {
+		for x := -r; x <= r; x++ {
+			if x*x+y*y <= r*r {
+				img.SetRGBA(cx+x, cy+y, c)
+			}
+		}
+	}
+}
+
+func runRenderMap(args []string) {
+	fs := flag.NewFlagSet("render-map", flag.ExitOnError)
+	lf := addLogFlags(fs)
+	sf := addSourceFlags(fs)
+	mapPath := fs.String("map", "", "map image to draw on (default: the project's map_image file)")
+	outPath := fs.String("o", "", "output PNG file (default: {project_id}_map.png next to the source file)")
+	fs.Parse(args)
+	lf.apply()
+	src := sf.load(fs)
+	logIssues(applog, src.issues)
+
+	projectID, path, ok := projectMapImage(src)
+	if *mapPath != "" {
+		path, ok = *mapPath, true
+	}
+	if !ok {
+		applog.fatal("The project has no local map_image file, use -map to name one")
+	}
+	if *outPath == "" {
+		if projectID == "" {
+			projectID = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+		*outPath = filepath.Join(src.dir(), projectID+"_map.png")
+	}
+
+	img, err := loadPicture(path)
+	if err != nil {
+		applog.fatal("Can't read map image", "path", path, "err", err)
+	}
+	// Refs without usable coordinates were reported while loading the source.
+	markers, _ := mapMarkers(src.measurementrefslines)
+	renderMap(img, markers)
+
+	f, err := os.Create(*outPath)
+	if err != nil {
+		applog.fatal(err.Error())
+	}
+	if err = png.Encode(f, img); err != nil {
+		f.Close()
+		applog.fatal("Can't write map", "path", *outPath, "err", err)
+	}
+	if err = f.Close(); err != nil {
+		applog.fatal(err.Error())
+	}
+	applog.info("Map written", "project", projectID, "markers", len(markers), "path", *outPath)
+}
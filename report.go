@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"html/template"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/tealeg/xlsx"
+)
+
+// reportField is one labelled value of the report header.
+type reportField struct {
+	Label string
+	Value string
+}
+
+// reportRow is the result of one cable: measured against expected elongation.
+type reportRow struct {
+	CableID     string
+	Designation string
+	Double      bool
+	Measured    float64
+	Expected    float64
+	Min         float64
+	Max         float64
+	HasExpected bool
+	// HasDeviation is false when the expected elongation is 0, e.g. for a
+	// stored designation without theoretical_elongation.
+	HasDeviation bool
+	Deviation    float64
+	Pass         bool
+}
+
+// stressingReport is the elongation report of one project, the same for a
+// project read from the workbook and one read back from Firestore.
+type stressingReport struct {
+	ProjectID   string
+	Generated   string
+	Header      []reportField
+	Calibration []reportField
+	Rows        []reportRow
+
+	Cables           int
+	Passed           int
+	Failed           int
+	Unchecked        int
+	AverageDeviation float64
+}
+
+var reportHeaderFields = []reportField{
+	{"Project ID", "project_id"},
+	{"Name", "name"},
+	{"Number", "number"},
+	{"Client", "client_name"},
+	{"Address", "address_line_1"},
+	{"", "address_line_2"},
+	{"Location", "general_location"},
+	{"Floor", "floor"},
+	{"Stressing company", "stressing_company_name"},
+	{"Stressing location", "stressing_location"},
+	{"Work order", "work_order_number"},
+	{"PT specification", "pt_specification"},
+	{"Engineer", "engineer_id"},
+	{"Field tech", "field_tech_id"},
+	{"Start date", "start_date"},
+	{"Weather", "weather"},
+}
+
+var reportCalibrationFields = []reportField{
+	{"Ram", "ram"},
+	{"Gauge", "gauge"},
+	{"Pump", "pump"},
+	{"Calibration date", "calibration_date"},
+	{"Calibration pressure (psi)", "calibration_psi"},
+	{"Calibration force (kips)", "calibration_force"},
+}
+
+// reportCable is what the report needs of a stored measurement.
+type reportCable struct {
+	id          string
+	designation string
+	double      bool
+	elongation  float64
+}
+
+func newStressingReport(project map[string]interface{}, cables []reportCable, expected map[string]expectedElongation) *stressingReport {
+	r := &stressingReport{
+		ProjectID: reportValue(project["project_id"]),
+		Generated: time.Now().Format("2006-01-02 15:04"),
+	}
+	for _, f := range reportHeaderFields {
+		r.Header = append(r.Header, reportField{f.Label, reportValue(project[f.Value])})
+	}
+	for _, f := range reportCalibrationFields {
+		r.Calibration = append(r.Calibration, reportField{f.Label, reportValue(project[f.Value])})
+	}
+
+	var deviations float64
+	var deviated int
+	for _, c := range cables {
+		row := reportRow{CableID: c.id, Designation: c.designation, Double: c.double, Measured: c.elongation}
+		if e, ok := expected[c.designation]; ok {
+			row.HasExpected = true
+			row.Expected, row.Min, row.Max = e.theoretical, e.min, e.max
+			if e.theoretical != 0 {
+				row.HasDeviation = true
+				row.Deviation = (c.elongation - e.theoretical) / e.theoretical * 100
+				deviations += math.Abs(row.Deviation)
+				deviated++
+			}
+			row.Pass = c.elongation >= e.min && c.elongation <= e.max
+			if row.Pass {
+				r.Passed++
+			} else {
+				r.Failed++
+			}
+		} else {
+			r.Unchecked++
+		}
+		r.Rows = append(r.Rows, row)
+	}
+	r.Cables = len(cables)
+	if deviated != 0 {
+		r.AverageDeviation = deviations / float64(deviated)
+	}
+	return r
+}
+
+func reportValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return v.Format("2006-01-02")
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// reportFromSource builds the report of a project of the workbook.
+func reportFromSource(src *sourceData, projectID string) (*stressingReport, error) {
+	for _, line := range src.projectlines {
+		if line["project_id"] == "" || (projectID != "" && line["project_id"] != projectID) {
+			continue
+		}
+		project := make(map[string]interface{}, len(line))
+		for k, v := range line {
+			project[k] = v
+		}
+		if force, err := calibrationForce(line, src.curves); err == nil {
+			project["calibration_force"] = math.Round(force*100) / 100
+		}
+		cables := make([]reportCable, 0, len(src.cables))
+		for _, c := range src.cables {
+			cables = append(cables, reportCable{c.id, c.designation, c.isDouble, c.elongation()})
+		}
+		return newStressingReport(project, cables, src.expected), nil
+	}
+	return nil, fmt.Errorf("project %q is not in the source file", projectID)
+}
+
+// reportFromFirestore builds the report from the documents an upload wrote.
+func reportFromFirestore(ctx context.Context, client *firestore.Client, projectID string) (*stressingReport, error) {
+	projectRef := client.Collection(collection(projectCollection)).Doc(projectID)
+	snap, err := projectRef.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	project := snap.Data()
+	project["project_id"] = projectID
+
+	expected := make(map[string]expectedElongation)
+	err = eachSnapshot(projectRef.Collection("designations").Documents(ctx), func(snap *firestore.DocumentSnapshot) error {
+		d := snap.Data()
+		theoretical, ok := d["theoretical_elongation"].(float64)
+		if !ok {
+			return nil
+		}
+		min, _ := d["elongation_min"].(float64)
+		max, _ := d["elongation_max"].(float64)
+		expected[reportValue(d["name"])] = expectedElongation{theoretical, min, max}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var cables []reportCable
+	err = eachSnapshot(projectRef.Collection("measurements").OrderBy("cable_id", firestore.Asc).Documents(ctx), func(snap *firestore.DocumentSnapshot) error {
+		d := snap.Data()
+		elongation, _ := d["elongation"].(float64)
+		double, _ := d["is_double"].(bool)
+		cables = append(cables, reportCable{reportValue(d["cable_id"]), reportValue(d["designation"]), double, elongation})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newStressingReport(project, cables, expected), nil
+}
+
+func (r *stressingReport) writeXLSX(path string) error {
+	file := xlsx.NewFile()
+	sheet, err := file.AddSheet("Report")
+	if err != nil {
+		return err
+	}
+	bold := xlsx.NewStyle()
+	bold.Font.Bold = true
+	bold.ApplyFont = true
+
+	title := sheet.AddRow().AddCell()
+	title.SetString("Stressing report " + r.ProjectID)
+	title.SetStyle(bold)
+	sheet.AddRow().AddCell().SetString("Generated " + r.Generated)
+	for _, group := range [][]reportField{r.Header, r.Calibration} {
+		sheet.AddRow()
+		for _, f := range group {
+			row := sheet.AddRow()
+			row.AddCell().SetString(f.Label)
+			row.AddCell().SetString(f.Value)
+		}
+	}
+
+	sheet.AddRow()
+	head := sheet.AddRow()
+	for _, h := range []string{"Cable", "Designation", "Double", "Measured (in)", "Expected (in)", "Min (in)", "Max (in)", "Deviation (%)", "Result"} {
+		c := head.AddCell()
+		c.SetString(h)
+		c.SetStyle(bold)
+	}
+	for _, rr := range r.Rows {
+		row := sheet.AddRow()
+		row.AddCell().SetString(rr.CableID)
+		row.AddCell().SetString(rr.Designation)
+		row.AddCell().SetBool(rr.Double)
+		row.AddCell().SetFloatWithFormat(rr.Measured, "0.00")
+		if !rr.HasExpected {
+			for i := 0; i < 4; i++ {
+				row.AddCell()
+			}
+			row.AddCell().SetString(rr.Result())
+			continue
+		}
+		row.AddCell().SetFloatWithFormat(rr.Expected, "0.00")
+		row.AddCell().SetFloatWithFormat(rr.Min, "0.00")
+		row.AddCell().SetFloatWithFormat(rr.Max, "0.00")
+		if rr.HasDeviation {
+			row.AddCell().SetFloatWithFormat(rr.Deviation, "0.0")
+		} else {
+			row.AddCell()
+		}
+		row.AddCell().SetString(rr.Result())
+	}
+
+	sheet.AddRow()
+	for _, t := range []struct {
+		label string
+		value float64
+	}{
+		{"Cables", float64(r.Cables)},
+		{"Passed", float64(r.Passed)},
+		{"Failed", float64(r.Failed)},
+		{"Without expected elongation", float64(r.Unchecked)},
+		{"Average deviation (%)", math.Round(r.AverageDeviation*10) / 10},
+	} {
+		row := sheet.AddRow()
+		c := row.AddCell()
+		c.SetString(t.label)
+		c.SetStyle(bold)
+		row.AddCell().SetFloat(t.value)
+	}
+	return file.Save(path)
+}
+
+func (rr reportRow) Result() string {
+	switch {
+	case !rr.HasExpected:
+		return "n/a"
+	case rr.Pass:
+		return "PASS"
+	default:
+		return "FAIL"
+	}
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"num": func(f float64) string { return strconv.FormatFloat(f, 'f', 2, 64) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Stressing report {{.ProjectID}}</title>
+<style>
+body { font-family: Arial, sans-serif; font-size: 13px; margin: 24px; }
+h1 { font-size: 20px; }
+table { border-collapse: collapse; margin-bottom: 18px; }
+th, td { border: 1px solid #bbb; padding: 3px 8px; text-align: left; }
+th { background: #eee; }
+td.num { text-align: right; }
+tr.FAIL td { background: #fdd; }
+tr.PASS td.result { color: #080; font-weight: bold; }
+tr.FAIL td.result { color: #c00; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>Stressing report {{.ProjectID}}</h1>
+<p>Generated {{.Generated}}</p>
+<table>
+{{range .Header}}<tr><th>{{.Label}}</th><td>{{.Value}}</td></tr>
+{{end}}</table>
+<table>
+{{range .Calibration}}<tr><th>{{.Label}}</th><td>{{.Value}}</td></tr>
+{{end}}</table>
+<table>
+<tr><th>Cable</th><th>Designation</th><th>Double</th><th>Measured (in)</th><th>Expected (in)</th><th>Min (in)</th><th>Max (in)</th><th>Deviation (%)</th><th>Result</th></tr>
+{{range .Rows}}<tr class="{{.Result}}"><td>{{.CableID}}</td><td>{{.Designation}}</td><td>{{if .Double}}yes{{else}}no{{end}}</td><td class="num">{{num .Measured}}</td>{{if .HasExpected}}<td class="num">{{num .Expected}}</td><td class="num">{{num .Min}}</td><td class="num">{{num .Max}}</td><td class="num">{{if .HasDeviation}}{{num .Deviation}}{{end}}</td>{{else}}<td></td><td></td><td></td><td></td>{{end}}<td class="result">{{.Result}}</td></tr>
+{{end}}</table>
+<table>
+<tr><th>Cables</th><td class="num">{{.Cables}}</td></tr>
+<tr><th>Passed</th><td class="num">{{.Passed}}</td></tr>
+<tr><th>Failed</th><td class="num">{{.Failed}}</td></tr>
+<tr><th>Without expected elongation</th><td class="num">{{.Unchecked}}</td></tr>
+<tr><th>Average deviation (%)</th><td class="num">{{num .AverageDeviation}}</td></tr>
+</table>
+</body>
+</html>
+`))
+
+func (r *stressingReport) writeHTML(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = reportTemplate.Execute(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func runReport(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	lf := addLogFlags(fs)
+	pf := addProfileFlags(fs, false)
+	sf := addSourceFlags(fs)
+	projectID := fs.String("project", "", "project to report on (default: the first project of the source file)")
+	fromFirestore := fs.Bool("firestore", false, "read the project from Firestore instead of the source file, needs -project")
+	out := fs.String("o", "", "output file name without extension (default: {project_id}_report)")
+	fs.Parse(args)
+	lf.apply()
+
+	var report *stressingReport
+	dir := "."
+	if *fromFirestore {
+		if *projectID == "" {
+			applog.fatal("-firestore needs -project")
+		}
+		pf.load()
+		ctx := rootContext(0, false)
+		client, err := openFirestore(ctx, openApp(ctx))
+		if err != nil {
+			applog.fatal("Can't open Firestore", "err", err)
+		}
+		atExit(func() { client.Close() })
+		if report, err = reportFromFirestore(ctx, client, *projectID); err != nil {
+			applog.fatal("Can't read project", "project", *projectID, "err", err)
+		}
+	} else {
+		src := sf.load(fs)
+		logIssues(applog, src.issues)
+		// A designation with conflicting definitions has no expected
+		// elongation, its cables would show up without one.
+		if errs, _ := splitIssues(src.issues); len(errs) != 0 {
+			applog.fatal("Source data has problems, no report was written", "problems", len(errs))
+		}
+		var err error
+		if report, err = reportFromSource(src, *projectID); err != nil {
+			applog.fatal(err.Error())
+		}
+		dir = src.dir()
+	}
+
+	if *out == "" {
+		*out = filepath.Join(dir, report.ProjectID+"_report")
+	}
+	if err := report.writeXLSX(*out + ".xlsx"); err != nil {
+		applog.fatal("Can't write report", "path", *out+".xlsx", "err", err)
+	}
+	if err := report.writeHTML(*out + ".html"); err != nil {
+		applog.fatal("Can't write report", "path", *out+".html", "err", err)
+	}
+	applog.info("Report written", "project", report.ProjectID, "cables", report.Cables,
+		"passed", report.Passed, "failed", report.Failed, "xlsx", *out+".xlsx", "html", *out+".html")
+}
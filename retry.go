@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxRetryWait caps the backoff between two attempts.
+const maxRetryWait = 30 * time.Second
+
+// retryPolicy retries calls that fail with a transient error. The wait
+// before a retry grows exponentially from wait and is jittered, so parallel
+// workers don't retry in lockstep. budget is the number of retries the whole
+// run may spend, so a service that is down ends the run instead of stalling
+// it. Every attempt gets timeout to finish, 0 is no limit.
+type retryPolicy struct {
+	attempts int
+	wait     time.Duration
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	budget int
+	rand   *rand.Rand
+}
+
+func newRetryPolicy(attempts, budget int, wait, timeout time.Duration) *retryPolicy {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return &retryPolicy{attempts: attempts, wait: wait, timeout: timeout, budget: budget,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// do calls fn until it succeeds, fails with a permanent error or the
+// attempts or the budget are used up. onRetry is called before every retry.
+func (p *retryPolicy) do(ctx context.Context, fn func(ctx context.Context) error, onRetry func(attempt int, err error, wait time.Duration)) error {
+	for attempt := 1; ; attempt++ {
+		err := p.attempt(ctx, fn)
+		if err == nil || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		if attempt >= p.attempts {
+			return fmt.Errorf("%v (gave up after %d attempts)", err, attempt)
+		}
+		wait, ok := p.take(attempt)
+		if !ok {
+			return fmt.Errorf("%v (retry budget of the run is used up)", err)
+		}
+		onRetry(attempt, err, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (p *retryPolicy) attempt(ctx context.Context, fn func(ctx context.Context) error) error {
+	if p.timeout <= 0 {
+		return fn(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	return fn(ctx)
+}
+
+// take spends one retry of the budget and returns the jittered wait before
+// the retry that follows the given attempt.
+func (p *retryPolicy) take(attempt int) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.budget <= 0 {
+		return 0, false
+	}
+	p.budget--
+	max := p.wait << uint(attempt-1)
+	if max <= 0 || max > maxRetryWait {
+		max = maxRetryWait
+	}
+	return max/2 + time.Duration(p.rand.Int63n(int64(max/2)+1)), true
+}
+
+// googleapiError finds the HTTP status in errors of the Auth client, which
+// wraps the googleapi.Error of the backend into its own error type, and of
+// the Realtime Database client.
+var googleapiError = regexp.MustCompile(`(?:googleapi: Error|http error status:) (\d{3})`)
+
+// retryable tells transient errors, worth another attempt, from permanent
+// ones. gRPC errors come from Firestore, HTTP errors from Auth, Storage and
+// the Realtime Database.
+func retryable(err error) bool {
+	if err == nil || err == context.Canceled {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted, codes.ResourceExhausted:
+		return true
+	}
+	if e, ok := err.(*googleapi.Error); ok {
+		return retryableHTTP(e.Code)
+	}
+	if m := googleapiError.FindStringSubmatch(err.Error()); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return retryableHTTP(code)
+	}
+	if e, ok := err.(net.Error); ok {
+		return e.Timeout() || e.Temporary()
+	}
+	return false
+}
+
+func retryableHTTP(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retry runs a call of the upload with the retry policy and counts the
+// retries with the collection the call is about.
+func (u *uploader) retry(collection string, fn func(ctx context.Context) error) error {
+	return u.retryWith(u.ctx, collection, fn)
+}
+
+// retryWith is retry with another context than the one of the run, for the
+// bookkeeping that has to be written even after the run was canceled.
+func (u *uploader) retryWith(ctx context.Context, collection string, fn func(ctx context.Context) error) error {
+	return u.retries.do(ctx, fn, func(attempt int, err error, wait time.Duration) {
+		u.run.record(collection, func(c *uploadCounts) { c.retries++ })
+		u.log.warn("Retrying", "collection", collection, "attempt", attempt, "wait", wait.Round(time.Millisecond), "err", err)
+	})
+}
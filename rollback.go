@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// changesCollection is the subcollection of uploads/{runID} that records
+// every document the run wrote, so the run can be rolled back.
+const changesCollection = "changes"
+
+// docChange is one document written by an upload run. before is the state
+// the document had, nil when the run created it.
+type docChange struct {
+	path       string
+	created    bool
+	before     map[string]interface{}
+	updateTime time.Time
+}
+
+// relativePath turns the full resource name of a document into the path
+// client.Doc understands.
+func relativePath(ref *firestore.DocumentRef) string {
+	if i := strings.Index(ref.Path, "/documents/"); i >= 0 {
+		return ref.Path[i+len("/documents/"):]
+	}
+	return ref.Path
+}
+
+// recordChange stores what the run did to a document. A document written
+// twice by the same run keeps its first before-state and the last update time.
+// The record is written even when the run was canceled meanwhile, so a
+// rollback knows about every write that happened.
+func (u *uploader) recordChange(ref *firestore.DocumentRef, before *firestore.DocumentSnapshot, updateTime time.Time) error {
+	path := relativePath(ref)
+	u.mu.Lock()
+	seq, ok := u.changes[path]
+	if !ok {
+		seq = fmt.Sprintf("%06d", len(u.changes)+1)
+		u.changes[path] = seq
+	}
+	u.mu.Unlock()
+	doc := u.runRef().Collection(changesCollection).Doc(seq)
+	if ok {
+		return u.retryWith(context.Background(), changesCollection, func(ctx context.Context) error {
+			_, err := doc.Update(ctx, []firestore.Update{{Path: "update_time", Value: updateTime}})
+			return err
+		})
+	}
+
+	change := map[string]interface{}{
+		"path":        path,
+		"created":     before == nil,
+		"before":      nil,
+		"update_time": updateTime,
+	}
+	if before != nil {
+		change["before"] = before.Data()
+	}
+	return u.retryWith(context.Background(), changesCollection, func(ctx context.Context) error {
+		_, err := doc.Set(ctx, change)
+		return err
+	})
+}
+
+func readChanges(ctx context.Context, run *firestore.DocumentRef) (changes []docChange, err error) {
+	iter := run.Collection(changesCollection).OrderBy(firestore.DocumentID, firestore.Asc).Documents(ctx)
+	err = eachSnapshot(iter, func(snap *firestore.DocumentSnapshot) error {
+		d := snap.Data()
+		c := docChange{}
+		c.path, _ = d["path"].(string)
+		c.created, _ = d["created"].(bool)
+		c.before, _ = d["before"].(map[string]interface{})
+		c.updateTime, _ = d["update_time"].(time.Time)
+		changes = append(changes, c)
+		return nil
+	})
+	return changes, err
+}
+
+// rollbackRun undoes an upload run: documents it created are deleted and
+// documents it modified get their prior state back. Nothing is touched when
+// any of the documents was changed again after the run. A run that mirrored
+// the project tree to the Realtime Database is undone there as well.
+func rollbackRun(ctx context.Context, client *firestore.Client, runID string) (deleted, restored int, err error) {
+	runRef := client.Collection(collection(uploadsCollection)).Doc(runID)
+	runSnap, err := runRef.Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return 0, 0, fmt.Errorf("there is no upload run %s", runID)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if at, ok := runSnap.Data()["rolled_back_at"].(time.Time); ok {
+		return 0, 0, fmt.Errorf("upload run %s was already rolled back on %s", runID, at.Local().Format("2006-01-02 15:04"))
+	}
+	changes, err := readChanges(ctx, runRef)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(changes) == 0 {
+		return 0, 0, fmt.Errorf("upload run %s has no recorded changes", runID)
+	}
+	mirror, err := openRunMirror(ctx, runSnap.Data())
+	if err != nil {
+		return 0, 0, fmt.Errorf("opening the Realtime Database the run mirrored to: %v", err)
+	}
+
+	var conflicts []string
+	// current is the state the run left the documents in, which the mirror
+	// restore needs to find the fields the run added.
+	current := make(map[string]map[string]interface{})
+	for _, c := range changes {
+		snap, err := client.Doc(c.path).Get(ctx)
+		if err == nil {
+			current[c.path] = snap.Data()
+		}
+		switch {
+		case status.Code(err) == codes.NotFound:
+			if !c.created {
+				conflicts = append(conflicts, c.path+" was deleted")
+			}
+		case err != nil:
+			return 0, 0, err
+		case !snap.UpdateTime.Equal(c.updateTime):
+			conflicts = append(conflicts, fmt.Sprintf("%s was changed on %s", c.path, snap.UpdateTime.Local().Format("2006-01-02 15:04:05")))
+		}
+	}
+	if len(conflicts) != 0 {
+		return 0, 0, fmt.Errorf("documents were changed after upload run %s, not rolling back:\n  %s",
+			runID, strings.Join(conflicts, "\n  "))
+	}
+
+	// Undo in reverse order, so subcollections go before their project.
+	for i := len(changes) - 1; i >= 0; i-- {
+		c := changes[i]
+		// A document changed since the conflict check is left as it is: the
+		// delete has a precondition, Set has none, so the restore checks the
+		// update time in a transaction.
+		ref := client.Doc(c.path)
+		if c.created {
+			_, err = ref.Delete(ctx, firestore.LastUpdateTime(c.updateTime))
+			if status.Code(err) == codes.NotFound {
+				err = nil
+			} else if err == nil {
+				deleted++
+			}
+		} else {
+			err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+				snap, err := tx.Get(ref)
+				if err != nil {
+					return err
+				}
+				if !snap.UpdateTime.Equal(c.updateTime) {
+					return fmt.Errorf("it was changed on %s", snap.UpdateTime.Local().Format("2006-01-02 15:04:05"))
+				}
+				return tx.Set(ref, c.before)
+			})
+			if err == nil {
+				restored++
+			}
+		}
+		if err != nil {
+			return deleted, restored, fmt.Errorf("rolling back %s: %v", c.path, err)
+		}
+		if mirror != nil && mirrored(c.path) {
+			if c.created {
+				err = mirror.delete(ctx, c.path)
+			} else {
+				err = mirror.restore(ctx, c.path, c.before, current[c.path])
+			}
+			if err != nil {
+				return deleted, restored, fmt.Errorf("rolling back %s in the Realtime Database: %v", c.path, err)
+			}
+		}
+	}
+
+	_, err = runRef.Set(ctx, map[string]interface{}{
+		"rolled_back_at": time.Now(),
+		"rolled_back_by": serviceAccountEmail(target.Credentials),
+	}, firestore.MergeAll)
+	return deleted, restored, err
+}
+
+func runRollback(args []string) {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	lf := addLogFlags(fs)
+	pf := addProfileFlags(fs, true)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: firestoreUpload rollback [flags] <run_id>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	lf.apply()
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	pf.load()
+	pf.confirm("ROLLBACK ON")
+
+	ctx := rootContext(0, false)
+	client, err := openFirestore(ctx, openApp(ctx))
+	if err != nil {
+		applog.fatal("Can't open Firestore", "err", err)
+	}
+	atExit(func() { client.Close() })
+
+	deleted, restored, err := rollbackRun(ctx, client, fs.Arg(0))
+	if err != nil {
+		applog.fatal("Rollback failed", "run", fs.Arg(0), "deleted", deleted, "restored", restored, "err", err)
+	}
+	applog.info("Upload run rolled back", "run", fs.Arg(0), "deleted", deleted, "restored", restored)
+	applog.warn("Accounts created by the run in Firebase Auth are not removed", "run", fs.Arg(0))
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	firebase "firebase.google.com/go"
+	auth "firebase.google.com/go/auth"
+)
+
+// pendingTTL is how long a validated source waits for the user to confirm
+// its upload.
+const pendingTTL = time.Hour
+
+// server is the web UI and REST API of the serve command. A source takes two
+// requests: POST /api/sources validates it and returns the upload plan, POST
+// /api/sources/{id}/upload uploads it once the user confirmed the plan. The
+// upload runs the upload command as a child process, so it stops, retries
+// and records its run exactly as on the command line, with the signed-in
+// user as requested_by.
+type server struct {
+	app        *firebase.App
+	client     *firestore.Client
+	auth       *auth.Client
+	roles      map[string]bool
+	opts       sourceOptions
+	uploadArgs []string
+	dir        string
+	maxSize    int64
+	web        webConfig
+
+	mu        sync.Mutex
+	pending   map[string]*pendingSource
+	uploading bool
+}
+
+// webConfig is the Firebase configuration of the sign-in page.
+type webConfig struct {
+	APIKey     string
+	AuthDomain string
+}
+
+// pendingSource is a validated source waiting for its confirmation. Only the
+// user who posted it can upload it.
+type pendingSource struct {
+	id    string
+	uid   string
+	path  string
+	added time.Time
+}
+
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	lf := addLogFlags(fs)
+	pf := addProfileFlags(fs, true)
+	sf := addSourceFlags(fs)
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	roles := fs.String("roles", "admin", "comma separated values of the role claim that may upload")
+	apiKey := fs.String("api-key", "", "Web API key of the Firebase project for the sign-in page (Project settings, General)")
+	authDomain := fs.String("auth-domain", "", "auth domain of the sign-in page (default: {project_id}.firebaseapp.com)")
+	dir := fs.String("dir", "serve-uploads", "directory that keeps posted sources until they are uploaded")
+	maxSize := fs.Int64("max-size", 50, "largest source accepted, in MB")
+	history := fs.Bool("history", false, "run the uploads with -history")
+	fs.Parse(args)
+	lf.apply()
+	pf.load()
+
+	if *apiKey == "" {
+		applog.fatal("serve needs the -api-key of the Firebase project for its sign-in page")
+	}
+	// Image paths of posted sources would name files of the server.
+	*sf.imageURLs = true
+	opts, err := sf.options()
+	if err != nil {
+		applog.fatal(err.Error())
+	}
+	if *authDomain == "" {
+		*authDomain = target.projectID() + ".firebaseapp.com"
+	}
+	pf.confirm("SERVE UPLOADS TO")
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		applog.fatal("Can't create the directory for posted sources", "dir", *dir, "err", err)
+	}
+
+	ctx := rootContext(0, false)
+	app := openApp(ctx)
+	client, err := openFirestore(ctx, app)
+	if err != nil {
+		applog.fatal("Can't open Firestore", "err", err)
+	}
+	atExit(func() { client.Close() })
+	authClient, err := app.Auth(ctx)
+	if err != nil {
+		applog.fatal("Can't open Auth client", "err", err)
+	}
+
+	s := &server{
+		app:        app,
+		client:     client,
+		auth:       authClient,
+		roles:      make(map[string]bool),
+		opts:       opts,
+		uploadArgs: append(pf.args(), sf.args()...),
+		dir:        *dir,
+		maxSize:    *maxSize << 20,
+		web:        webConfig{APIKey: *apiKey, AuthDomain: *authDomain},
+		pending:    make(map[string]*pendingSource),
+	}
+	for _, role := range strings.Split(*roles, ",") {
+		s.roles[strings.TrimSpace(role)] = true
+	}
+	if *history {
+		s.uploadArgs = append(s.uploadArgs, "-history")
+	}
+
+	srv := &http.Server{Addr: *addr, Handler: s.routes()}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), finishTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	applog.info("Serving", "addr", *addr, "roles", *roles)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		applog.fatal("Can't serve", "addr", *addr, "err", err)
+	}
+	applog.info("Stopped serving")
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handlePage)
+	mux.HandleFunc("/api/sources", s.authorize(s.handleSource))
+	mux.HandleFunc("/api/sources/", s.authorize(s.handleUpload))
+	return mux
+}
+
+// authorize lets a request through when it carries the ID token of a user
+// whose role claim is one of the roles of the server, as
+// "Authorization: Bearer <ID token>".
+func (s *server) authorize(h func(w http.ResponseWriter, r *http.Request, tok *auth.Token)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		idToken := strings.TrimPrefix(header, "Bearer ")
+		if idToken == "" || idToken == header {
+			writeError(w, http.StatusUnauthorized, "sign in first")
+			return
+		}
+		tok, err := s.auth.VerifyIDToken(r.Context(), idToken)
+		if err != nil {
+			applog.warn("Rejected ID token", "remote", r.RemoteAddr, "err", err)
+			writeError(w, http.StatusUnauthorized, "the ID token is not valid, sign in again")
+			return
+		}
+		role, _ := tok.Claims["role"].(string)
+		if !s.roles[role] {
+			applog.warn("Rejected user without upload role", "uid", tok.UID, "role", role)
+			writeError(w, http.StatusForbidden, fmt.Sprintf("users with role %q may not upload", role))
+			return
+		}
+		h(w, r, tok)
+	}
+}
+
+func (s *server) handlePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := servePage.Execute(w, s.web); err != nil {
+		applog.error("Can't render page", "err", err)
+	}
+}
+
+// handleSource validates a posted source, the form file "source", and makes
+// its upload plan. A source without problems is kept for its upload.
+func (s *server) handleSource(w http.ResponseWriter, r *http.Request, tok *auth.Token) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxSize)
+	file, header, err := r.FormFile("source")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("no source file: %v", err))
+		return
+	}
+	defer file.Close()
+
+	id, err := newRunID(time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	path := filepath.Join(s.dir, id, filepath.Base(header.Filename))
+	if err := saveUpload(path, file); err != nil {
+		os.RemoveAll(filepath.Dir(path))
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("can't store the source: %v", err))
+		return
+	}
+	log := applog.with("uid", tok.UID, "source", id, "file", header.Filename)
+
+	src, err := loadSource(path, s.opts)
+	if err != nil {
+		os.RemoveAll(filepath.Dir(path))
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("can't read the source: %v", err))
+		return
+	}
+	resp := map[string]interface{}{"id": id, "file": header.Filename, "issues": src.issues}
+	ok := false
+	if errs, _ := splitIssues(src.issues); len(errs) == 0 {
+		plan, err := makePlan(r.Context(), s.app, s.client, src)
+		if err != nil {
+			os.RemoveAll(filepath.Dir(path))
+			log.error("Can't make the upload plan", "err", err)
+			writeError(w, http.StatusBadGateway, fmt.Sprintf("can't make the upload plan: %v", err))
+			return
+		}
+		resp["plan"] = plan
+		ok = len(plan.issues) == 0
+	}
+	resp["ok"] = ok
+	if ok {
+		s.addPending(&pendingSource{id: id, uid: tok.UID, path: path, added: time.Now()})
+	} else {
+		os.RemoveAll(filepath.Dir(path))
+	}
+	log.info("Source validated", "issues", len(src.issues), "ok", ok)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleUpload uploads a pending source, POST /api/sources/{id}/upload. One
+// upload runs at a time. A failed upload stays pending so it can be tried
+// again.
+func (s *server) handleUpload(w http.ResponseWriter, r *http.Request, tok *auth.Token) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/sources/"), "/")
+	if len(parts) != 2 || parts[1] != "upload" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	p, status, msg := s.startUpload(parts[0], tok.UID)
+	if p == nil {
+		writeError(w, status, msg)
+		return
+	}
+	defer s.endUpload()
+
+	email, _ := tok.Claims["email"].(string)
+	log := applog.with("uid", tok.UID, "email", email, "source", p.id)
+	log.info("Upload confirmed")
+	result, err := s.upload(p, email)
+	if err != nil {
+		log.error("Can't run the upload", "err", err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("can't run the upload: %v", err))
+		return
+	}
+	if result["exit_code"] == 0 {
+		s.mu.Lock()
+		delete(s.pending, p.id)
+		s.mu.Unlock()
+		os.RemoveAll(filepath.Dir(p.path))
+	}
+	log.info("Upload done", "exit_code", result["exit_code"])
+	writeJSON(w, http.StatusOK, result)
+}
+
+// addPending keeps a validated source and drops the ones that weren't
+// confirmed in time.
+func (s *server) addPending(p *pendingSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, old := range s.pending {
+		if time.Since(old.added) > pendingTTL {
+			delete(s.pending, id)
+			os.RemoveAll(filepath.Dir(old.path))
+		}
+	}
+	s.pending[p.id] = p
+}
+
+// startUpload returns the pending source of the user, or the status and
+// message of the error.
+func (s *server) startUpload(id, uid string) (*pendingSource, int, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pending[id]
+	if !ok || p.uid != uid || time.Since(p.added) > pendingTTL {
+		return nil, http.StatusNotFound, "no validated source with this ID, post it again"
+	}
+	if s.uploading {
+		return nil, http.StatusConflict, "another upload is running, try again when it is done"
+	}
+	s.uploading = true
+	return p, 0, ""
+}
+
+func (s *server) endUpload() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploading = false
+}
+
+// upload runs the upload of a pending source and returns its exit code, its
+// console output and its log entries.
+func (s *server) upload(p *pendingSource, email string) (map[string]interface{}, error) {
+	logPath := filepath.Join(filepath.Dir(p.path), "upload.jsonl")
+	os.Remove(logPath)
+	args := append([]string{"-log-file", logPath, "-requested-by", email}, s.uploadArgs...)
+	code, out, err := runChildUpload(p.path, args)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readLogFile(logPath)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"exit_code": code, "output": string(out), "log": entries}, nil
+}
+
+// runChildUpload runs the upload command of this program for a source as a
+// child process, with the given flags, and returns its exit code and its
+// console output.
+func runChildUpload(path string, args []string) (code int, output []byte, err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, nil, err
+	}
+	args = append(append([]string{"upload"}, args...), path)
+	output, err = exec.Command(exe, args...).CombinedOutput()
+	if err != nil {
+		e, ok := err.(*exec.ExitError)
+		if !ok {
+			return 0, nil, err
+		}
+		return e.ExitCode(), output, nil
+	}
+	return 0, output, nil
+}
+
+// readLogFile reads the entries of a JSON lines log file.
+func readLogFile(path string) ([]json.RawMessage, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []json.RawMessage
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			entries = append(entries, json.RawMessage(line))
+		}
+	}
+	return entries, sc.Err()
+}
+
+func saveUpload(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		applog.warn("Can't write response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// servePage is the web UI: sign in with Firebase Auth, post a source, check
+// its problems and the upload plan and confirm the upload.
+var servePage = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>firestoreUpload</title>
+<script src="https://www.gstatic.com/firebasejs/8.10.1/firebase-app.js"></script>
+<script src="https://www.gstatic.com/firebasejs/8.10.1/firebase-auth.js"></script>
+<style>
+body { font-family: sans-serif; margin: 2em; max-width: 60em; }
+table { border-collapse: collapse; margin: 1em 0; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+.error { color: #b00; }
+.warning { color: #a60; }
+pre { background: #f4f4f4; padding: 1em; overflow: auto; }
+[hidden] { display: none; }
+</style>
+</head>
+<body>
+<h1>Upload workbook</h1>
+<form id="signin">
+<input id="email" type="email" placeholder="e-mail" required>
+<input id="password" type="password" placeholder="password" required>
+<button>Sign in</button>
+</form>
+<div id="main" hidden>
+<p>Signed in as <span id="user"></span> <button id="signout">Sign out</button></p>
+<form id="post">
+<input id="source" type="file" accept=".xlsx,.json,.ndjson,.jsonl" required>
+<button>Validate</button>
+</form>
+</div>
+<p id="message"></p>
+<div id="result" hidden>
+<h2>Problems</h2>
+<table id="issues"><tr><th>Sheet</th><th>Row</th><th>Key</th><th>Problem</th></tr></table>
+<div id="plan" hidden>
+<h2>Plan</h2>
+<table id="projects"><tr><th>Project</th><th>Action</th><th>Status</th></tr></table>
+<table id="documents"><tr><th>Collection</th><th>Documents</th></tr></table>
+<p id="users"></p>
+<button id="confirm">Upload</button>
+</div>
+</div>
+<pre id="output" hidden></pre>
+<script>
+firebase.initializeApp({apiKey: {{.APIKey}}, authDomain: {{.AuthDomain}}});
+const auth = firebase.auth();
+const $ = id => document.getElementById(id);
+let sourceID = null;
+
+function message(text, isError) {
+  $("message").textContent = text;
+  $("message").className = isError ? "error" : "";
+}
+
+function row(table, cells, cls) {
+  const tr = $(table).insertRow();
+  if (cls) tr.className = cls;
+  for (const c of cells) tr.insertCell().textContent = c;
+}
+
+function clear(table) {
+  while ($(table).rows.length > 1) $(table).deleteRow(1);
+}
+
+async function api(path, body) {
+  const token = await auth.currentUser.getIdToken();
+  const resp = await fetch(path, {method: "POST", headers: {Authorization: "Bearer " + token}, body: body});
+  const data = await resp.json();
+  if (!resp.ok) throw new Error(data.error);
+  return data;
+}
+
+auth.onAuthStateChanged(user => {
+  $("signin").hidden = !!user;
+  $("main").hidden = !user;
+  $("user").textContent = user ? user.email : "";
+});
+
+$("signin").onsubmit = e => {
+  e.preventDefault();
+  auth.signInWithEmailAndPassword($("email").value, $("password").value).catch(err => message(err.message, true));
+};
+
+$("signout").onclick = () => auth.signOut();
+
+$("post").onsubmit = async e => {
+  e.preventDefault();
+  $("result").hidden = $("plan").hidden = $("output").hidden = true;
+  message("Validating...");
+  const form = new FormData();
+  form.append("source", $("source").files[0]);
+  try {
+    const data = await api("/api/sources", form);
+    clear("issues"); clear("projects"); clear("documents");
+    for (const i of data.issues || []) row("issues", [i.sheet, i.row || "", i.key || "", i.msg], i.warning ? "warning" : "error");
+    if (data.plan) {
+      for (const i of data.plan.issues || []) row("issues", [i.sheet, i.row || "", i.key || "", i.msg], "error");
+      for (const p of data.plan.projects) {
+        row("projects", [p.project_id, p.exists ? "update" : "create", p.exists && p.status_from != p.status_to ? p.status_from + " -> " + p.status_to : p.status_to]);
+      }
+      for (const [coll, n] of Object.entries(data.plan.documents)) row("documents", [coll, n]);
+      $("users").textContent = data.plan.users ? data.plan.users + " users, new accounts: " + ((data.plan.new_users || []).join(", ") || "none") : "";
+    }
+    sourceID = data.id;
+    $("plan").hidden = !data.ok;
+    $("result").hidden = false;
+    message(data.ok ? "No problems. Check the plan and confirm the upload." : "Fix the problems and post the file again.", !data.ok);
+  } catch (err) {
+    message(err.message, true);
+  }
+};
+
+$("confirm").onclick = async () => {
+  $("confirm").disabled = true;
+  message("Uploading...");
+  try {
+    const data = await api("/api/sources/" + encodeURIComponent(sourceID) + "/upload");
+    $("output").textContent = data.output;
+    $("output").hidden = false;
+    $("plan").hidden = data.exit_code == 0;
+    message(data.exit_code == 0 ? "Upload finished." : "Upload failed with exit code " + data.exit_code + ", see the output. Confirm again to retry.", data.exit_code != 0);
+  } catch (err) {
+    message(err.message, true);
+  } finally {
+    $("confirm").disabled = false;
+  }
+};
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// exitInterrupted is the exit code of a command stopped by Ctrl-C or
+// SIGTERM, as shells report it for SIGINT.
+const exitInterrupted = 130
+
+var (
+	// interrupted is closed on the first SIGINT or SIGTERM.
+	interrupted   = make(chan struct{})
+	interruptOnce sync.Once
+
+	exitMu   sync.Mutex
+	cleanups []func()
+
+	// stdinLines gets the lines of stdin from a single reader, so input
+	// typed ahead isn't lost between prompts. It is closed at the end of
+	// stdin.
+	stdinLines    = make(chan string)
+	stdinReadOnce sync.Once
+)
+
+func isInterrupted() bool {
+	select {
+	case <-interrupted:
+		return true
+	default:
+		return false
+	}
+}
+
+// rootContext returns the context of a command, canceled when timeout
+// passes (0 is no deadline) or on SIGINT/SIGTERM. A graceful command only
+// sees interrupted on the first signal, so it can stop starting work and let
+// the calls in flight finish; the second signal cancels them as well.
+func rootContext(timeout time.Duration, graceful bool) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		atExit(cancelTimeout)
+	}
+	atExit(cancel)
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		interruptOnce.Do(func() { close(interrupted) })
+		if graceful {
+			applog.warn("Interrupted, finishing the writes in flight. Interrupt again to abandon them")
+			<-signals
+			applog.warn("Abandoning the writes in flight")
+		}
+		cancel()
+	}()
+	return ctx
+}
+
+// atExit registers a cleanup that exit runs, like a defer that also runs
+// when the program stops with an error.
+func atExit(f func()) {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	cleanups = append(cleanups, f)
+}
+
+// exit runs the cleanups, last registered first, and ends the program.
+func exit(code int) {
+	exitMu.Lock()
+	fs := cleanups
+	cleanups = nil
+	exitMu.Unlock()
+	for i := len(fs) - 1; i >= 0; i-- {
+		fs[i]()
+	}
+	applog.sink.close()
+	os.Exit(code)
+}
+
+// stdinIsTerminal tells whether somebody can type answers. It is false for
+// pipes and files and for the null device, which scheduled tasks and the
+// uploads run by serve and watch get.
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
+
+// readLine reads a line typed on stdin. The read itself can't be canceled,
+// so it runs aside and ok is false when the command is interrupted first; a
+// line that arrives later goes to the next readLine.
+func readLine() (line string, ok bool) {
+	stdinReadOnce.Do(func() {
+		go func() {
+			stdin := bufio.NewReader(os.Stdin)
+			for {
+				line, err := stdin.ReadString('\n')
+				if line != "" {
+					stdinLines <- line
+				}
+				if err != nil {
+					close(stdinLines)
+					return
+				}
+			}
+		}()
+	})
+	select {
+	case line = <-stdinLines:
+		return line, true
+	case <-interrupted:
+		return "", false
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sourceSheets are the rows of a source, whatever format it came in. In a
+// workbook the Manipulate rows are measurements, designations and
+// measurement-refs at the same time, other formats may list them apart.
+type sourceSheets struct {
+	users        []map[string]string
+	project      []map[string]string
+	contacts     []map[string]string
+	measurements []map[string]string
+	designations []map[string]string
+	refs         []map[string]string
+	calibration  []map[string]string
+}
+
+// setManipulate uses the rows of a Manipulate sheet for the measurements,
+// designations and measurement-refs.
+func (s *sourceSheets) setManipulate(lines []map[string]string) {
+	s.measurements, s.designations, s.refs = lines, lines, lines
+}
+
+// sourceReader reads one source format. Every format gives the same rows as
+// the upload workbook, so validation and upload don't depend on the format.
+type sourceReader interface {
+	read(path string) (*sourceSheets, error)
+}
+
+// readerOptions are the settings of the text formats.
+type readerOptions struct {
+	delimiter rune
+	encoding  string
+}
+
+// openSourceReader picks the reader for path: a directory of CSV files, an
+// xlsx workbook or a JSON or JSON lines file.
+func openSourceReader(path string, opts readerOptions) (sourceReader, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return csvDirReader{opts}, nil
+	}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".xlsx":
+		return xlsxReader{}, nil
+	case ".json":
+		return jsonReader{}, nil
+	case ".ndjson", ".jsonl":
+		return ndjsonReader{}, nil
+	default:
+		return nil, fmt.Errorf("unknown source format %q, use an .xlsx, .json or .ndjson file or a directory of CSV files", ext)
+	}
+}
+
+// xlsxReader reads the upload workbook.
+type xlsxReader struct{}
+
+func (xlsxReader) read(path string) (*sourceSheets, error) {
+	s := &sourceSheets{}
+	var manipulate []map[string]string
+	var err error
+	s.users, s.project, manipulate, _, _, s.contacts, err = readFromSourceExcel(path)
+	if err != nil {
+		return nil, err
+	}
+	s.setManipulate(manipulate)
+	if s.calibration, err = readCalibrations(path); err != nil {
+		return nil, fmt.Errorf("Error reading calibrations from %q: %v", path, err)
+	}
+	return s, nil
+}
+
+// readCalibrationFile reads a separate calibration table, a CSV file or a
+// workbook, see readCalibrations.
+func readCalibrationFile(path string, opts readerOptions) ([]map[string]string, error) {
+	if strings.ToLower(filepath.Ext(path)) == ".csv" {
+		return readCSVFile(path, opts)
+	}
+	return readCalibrations(path)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// projectStatus is the stage of a project. It is stored as the integer the
+// app reads, together with its name.
+type projectStatus int
+
+const (
+	statusDraft projectStatus = iota
+	statusFieldStarted
+	statusFieldSubmitted
+	statusEngineerSubmitted
+	statusApproved
+)
+
+var statusNames = []string{"draft", "field_started", "field_submitted", "engineer_submitted", "approved"}
+
+func (s projectStatus) String() string {
+	if s < 0 || int(s) >= len(statusNames) {
+		return strconv.Itoa(int(s))
+	}
+	return statusNames[s]
+}
+
+// statusTransitions lists where a project may go from each status. Besides
+// the way forward, a field submission can be reopened and the engineer can
+// send the project back to the field.
+var statusTransitions = map[projectStatus][]projectStatus{
+	statusDraft:             {statusFieldStarted},
+	statusFieldStarted:      {statusFieldSubmitted},
+	statusFieldSubmitted:    {statusFieldStarted, statusEngineerSubmitted},
+	statusEngineerSubmitted: {statusFieldStarted, statusApproved},
+	statusApproved:          {},
+}
+
+// statusStamps is the timestamp field set when a project enters a status.
+var statusStamps = map[projectStatus]string{
+	statusFieldStarted:      "field_started_at",
+	statusFieldSubmitted:    "field_submitted_at",
+	statusEngineerSubmitted: "engineer_submitted_at",
+}
+
+// parseStatus accepts the status as its number or its name, with spaces or
+// underscores. An empty status is a draft.
+func parseStatus(v string) (projectStatus, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return statusDraft, nil
+	}
+	if n, err := strconv.Atoi(v); err == nil {
+		if n < 0 || n >= len(statusNames) {
+			return 0, fmt.Errorf("unknown status %d", n)
+		}
+		return projectStatus(n), nil
+	}
+	name := strings.Replace(strings.ToLower(v), " ", "_", -1)
+	for i, s := range statusNames {
+		if s == name {
+			return projectStatus(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown status %q, use one of %s", v, strings.Join(statusNames, ", "))
+}
+
+func canTransition(from, to projectStatus) bool {
+	if from == to {
+		return true
+	}
+	for _, s := range statusTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+func checkStatuses(projectlines []map[string]string) (issues []validationIssue) {
+	for _, line := range projectlines {
+		if line["project_id"] == "" {
+			continue
+		}
+		if _, err := parseStatus(line["status"]); err != nil {
+			issues = append(issues, validationIssue{sheet: "Project", row: rowOf(line), key: line["project_id"], msg: err.Error()})
+		}
+	}
+	return issues
+}
+
+// statusChange is the status of a project in Firestore and in the upload.
+type statusChange struct {
+	from   projectStatus
+	to     projectStatus
+	exists bool
+}
+
+// planStatusChanges reads the current status of every project of the upload
+// and reports transitions the workflow doesn't allow.
+func planStatusChanges(ctx context.Context, client *firestore.Client, projectlines []map[string]string) (changes map[string]statusChange, issues []validationIssue, err error) {
+	changes = make(map[string]statusChange)
+	for _, line := range projectlines {
+		id := line["project_id"]
+		if id == "" {
+			continue
+		}
+		change := statusChange{}
+		change.to, _ = parseStatus(line["status"])
+
+		snap, err := client.Collection(collection(projectCollection)).Doc(id).Get(ctx)
+		if status.Code(err) == codes.NotFound {
+			changes[id] = change
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		change.exists = true
+		if v, ok := snap.Data()["status"].(int64); ok {
+			change.from = projectStatus(v)
+		}
+		if !canTransition(change.from, change.to) {
+			issues = append(issues, validationIssue{sheet: "Project", row: rowOf(line), key: id,
+				msg: fmt.Sprintf("status can't change from %s to %s", change.from, change.to)})
+		}
+		changes[id] = change
+	}
+	return changes, issues, nil
+}
+
+// applyStatus sets the status fields of a project document and stamps the
+// time the project entered its new status, unless the sheet gives one.
+// Empty timestamp columns are left out so stored stamps aren't wiped.
+func applyStatus(project map[string]interface{}, change statusChange, now time.Time) {
+	project["status"] = int(change.to)
+	project["status_name"] = change.to.String()
+	for _, field := range statusStamps {
+		if project[field] == nil {
+			delete(project, field)
+		}
+	}
+	field, ok := statusStamps[change.to]
+	if !ok || (change.exists && change.from == change.to) {
+		return
+	}
+	if _, given := project[field]; !given {
+		project[field] = now
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/tealeg/xlsx"
+)
+
+// templateRows is how far down the dropdowns and the date format of the
+// template reach.
+const templateRows = 1000
+
+// designationSheetName is the sheet of the template that lists the
+// designations offered in the Set Designation column. It comes after the
+// sheets the program reads, so it doesn't disturb their order.
+const designationSheetName = "Designations"
+
+// userRoles are the roles a user of the Users sheet can have.
+var userRoles = []string{"admin", "engineer", "field_tech"}
+
+// flagValues are the values of the 0/1 columns of the Manipulate sheet.
+var flagValues = []string{"0", "1"}
+
+// contactStatuses are the values of the status column of the Contacts sheet,
+// stored as the contact's statusType.
+var contactStatuses = []string{"0", "1"}
+
+// templateColumn is a column of the upload workbook. list are the values
+// offered as a dropdown, designations offers the designations of the
+// Designations sheet instead. Date columns are those of dateColumns.
+type templateColumn struct {
+	name         string
+	desc         string
+	list         []string
+	designations bool
+}
+
+type templateSheet struct {
+	name    string
+	columns []templateColumn
+}
+
+// templateSheets are the sheets of the upload workbook in the order the
+// program reads them, see readFromSourceExcel and readCalibrations.
+var templateSheets = []templateSheet{
+	{"Users", []templateColumn{
+		{name: "identifier", desc: "E-mail of the account, it is created when it doesn't exist."},
+		{name: "first_name", desc: "First name."},
+		{name: "last_name", desc: "Last name."},
+		{name: "role", desc: "Role of the user in the app.", list: userRoles},
+	}},
+	{"Project", []templateColumn{
+		{name: "project_id", desc: "Document ID of the project, must be unique. Required."},
+		{name: "name", desc: "Project name."},
+		{name: "number", desc: "Project number."},
+		{name: "status", desc: "Status of the project. An upload may only move it one step forward, see the readme.", list: statusNames},
+		{name: "address_line_1", desc: "Address."},
+		{name: "address_line_2", desc: "Address, second line."},
+		{name: "area", desc: "Area, a whole number."},
+		{name: "average_deviation", desc: "Average deviation, a whole number."},
+		{name: "benchmark", desc: "Benchmark."},
+		{name: "calibration_date", desc: "Date of the calibration certificate of the ram."},
+		{name: "calibration_psi", desc: "Gauge pressure in psi, converted to the calibration force with the ram's calibration table."},
+		{name: "client_name", desc: "Client."},
+		{name: "contact_name", desc: "Contact person at the site."},
+		{name: "contact_phone", desc: "Phone of the contact person."},
+		{name: "device_calibration_image", desc: "URL of the device calibration image, or a local file uploaded to Storage."},
+		{name: "engineer_id", desc: "User ID of the engineer."},
+		{name: "engineer_submitted_at", desc: "Date the engineer submitted the project, set by the upload when left empty."},
+		{name: "field_started_at", desc: "Date the field work started, set by the upload when left empty."},
+		{name: "field_submitted_at", desc: "Date the field work was submitted, set by the upload when left empty."},
+		{name: "field_tech_id", desc: "User ID of the field tech."},
+		{name: "floor", desc: "Floor."},
+		{name: "gauge", desc: "Gauge, with ram selects the calibration table."},
+		{name: "general_location", desc: "General location."},
+		{name: "map_image", desc: "URL of the map image, or a local file uploaded to Storage. x and y of the Manipulate sheet are pixels on it."},
+		{name: "pt_specification", desc: "PT specification."},
+		{name: "pump", desc: "Pump."},
+		{name: "ram", desc: "Ram, with gauge selects the calibration table."},
+		{name: "ram_certification_image", desc: "URL of the ram certification image, or a local file uploaded to Storage."},
+		{name: "sheet", desc: "Sheet."},
+		{name: "start_date", desc: "Start date."},
+		{name: "stressing_company_name", desc: "Stressing company."},
+		{name: "stressing_location", desc: "Stressing location."},
+		{name: "total_cables", desc: "Number of cables, checked against the Manipulate sheet."},
+		{name: "weather", desc: "Weather."},
+		{name: "work_order_number", desc: "Work order number."},
+	}},
+	{"Contacts", []templateColumn{
+		{name: "email", desc: "E-mail of the contact, must be unique. Rows without one are skipped."},
+		{name: "name", desc: "Name of the contact."},
+		{name: "status", desc: "Status of the contact.", list: contactStatuses},
+		{name: "project_id", desc: "Project of the contact, must be one of the Project sheet. Optional."},
+	}},
+	{"Manipulate", []templateColumn{
+		{name: "Set Designation", desc: "Designation of the cable, one of the Designations sheet. Required.", designations: true},
+		{name: "cable_id", desc: "Cable, one row per stressing end. Required."},
+		{name: "is_double", desc: "1 when the cable is stressed from both ends.", list: flagValues},
+		{name: "is_second_end", desc: "1 for the row of the second end of a double cable.", list: flagValues},
+		{name: "end_id", desc: "End of the cable."},
+		{name: "suffix", desc: "Suffix of the measurement-ref."},
+		{name: "x", desc: "Position of the end on the map image in pixels."},
+		{name: "y", desc: "Position of the end on the map image in pixels."},
+		{name: "elongation", desc: "Measured elongation in inches."},
+		{name: "tolerance_min", desc: "Lower tolerance of the designation in percent."},
+		{name: "tolerance_max", desc: "Upper tolerance of the designation in percent."},
+		{name: "tendon_length", desc: "Tendon length in ft, for the theoretical elongation."},
+		{name: "strand_area", desc: "Strand area in in²."},
+		{name: "modulus", desc: "Modulus of elasticity in ksi."},
+		{name: "jacking_force", desc: "Jacking force in kips."},
+		{name: "friction_coefficient", desc: "Curvature friction coefficient. Optional."},
+		{name: "wobble_coefficient", desc: "Wobble coefficient per ft. Optional."},
+		{name: "angle_change", desc: "Total angle change in radians. Optional."},
+		{name: "seating_loss", desc: "Seating loss in inches. Optional."},
+	}},
+	{calibrationSheetName, []templateColumn{
+		{name: "ram", desc: "Ram of the calibration certificate."},
+		{name: "gauge", desc: "Gauge of the calibration certificate."},
+		{name: "pressure", desc: "Gauge pressure in psi."},
+		{name: "force", desc: "Force at that pressure in kips."},
+	}},
+	{designationSheetName, []templateColumn{
+		{name: "Set Designation", desc: "The designations of the project, offered in the Set Designation column of the Manipulate sheet."},
+	}},
+}
+
+func isDateColumn(name string) bool {
+	for _, col := range dateColumns {
+		if col == name {
+			return true
+		}
+	}
+	return false
+}
+
+func runTemplate(args []string) {
+	fs := flag.NewFlagSet("template", flag.ExitOnError)
+	lf := addLogFlags(fs)
+	sf := addSourceFlags(fs)
+	out := fs.String("o", "upload_template.xlsx", "output workbook")
+	force := fs.Bool("force", false, "overwrite the output workbook when it exists")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: firestoreUpload template [flags] [source]\n\nWith a source, its designations are filled in the Designations sheet.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	lf.apply()
+
+	var designations []string
+	if fs.NArg() > 0 {
+		src := sf.load(fs)
+		for _, d := range src.designations {
+			designations = append(designations, d.name)
+		}
+	}
+	if fileExists(*out) && !*force {
+		applog.fatal("The output workbook exists, use -force to overwrite it", "path", *out)
+	}
+	if err := writeTemplate(*out, designations); err != nil {
+		applog.fatal("Can't write template", "path", *out, "err", err)
+	}
+	applog.info("Template written", "path", *out, "designations", len(designations))
+}
+
+// writeTemplate writes the upload workbook with its header rows and the
+// given designations. xlsx can't write comments or data validations, so they
+// are added to the parts it marshals.
+func writeTemplate(path string, designations []string) error {
+	f := xlsx.NewFile()
+	header := xlsx.NewStyle()
+	header.Font.Bold = true
+	header.ApplyFont = true
+	for _, ts := range templateSheets {
+		sheet, err := f.AddSheet(ts.name)
+		if err != nil {
+			return err
+		}
+		sheet.SheetViews = []xlsx.SheetView{{Pane: &xlsx.Pane{
+			YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft", State: "frozen"}}}
+		row := sheet.AddRow()
+		for _, c := range ts.columns {
+			cell := row.AddCell()
+			cell.SetString(c.name)
+			cell.SetStyle(header)
+		}
+		for i, c := range ts.columns {
+			col := sheet.Col(i)
+			col.Width = float64(len(c.name) + 4)
+			if col.Width < 12 {
+				col.Width = 12
+			}
+			if isDateColumn(c.name) {
+				col.SetType(xlsx.CellTypeDate)
+			}
+		}
+		if ts.name == designationSheetName {
+			for _, d := range designations {
+				sheet.AddRow().AddCell().SetString(d)
+			}
+		}
+	}
+
+	parts, err := f.MarshallParts()
+	if err != nil {
+		return err
+	}
+	var types []string
+	for i, ts := range templateSheets {
+		n := i + 1
+		name := fmt.Sprintf("xl/worksheets/sheet%d.xml", n)
+		parts[name] = templateSheetXML(parts[name], ts.columns)
+		parts[fmt.Sprintf("xl/worksheets/_rels/sheet%d.xml.rels", n)] = xml.Header +
+			`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			fmt.Sprintf(`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/comments" Target="../comments%d.xml"/>`, n) +
+			fmt.Sprintf(`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/vmlDrawing" Target="../drawings/vmlDrawing%d.vml"/>`, n) +
+			`</Relationships>`
+		parts[fmt.Sprintf("xl/comments%d.xml", n)] = templateComments(ts.columns)
+		parts[fmt.Sprintf("xl/drawings/vmlDrawing%d.vml", n)] = templateCommentShapes(ts.columns, n)
+		types = append(types, fmt.Sprintf(`<Override PartName="/xl/comments%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.comments+xml"/>`, n))
+	}
+	types = append(types, `<Default Extension="vml" ContentType="application/vnd.openxmlformats-officedocument.vmlDrawing"/>`)
+	parts["[Content_Types].xml"] = strings.Replace(parts["[Content_Types].xml"], "</Types>", strings.Join(types, "")+"</Types>", 1)
+	return writeParts(path, parts)
+}
+
+// templateSheetXML adds the dropdowns and the reference to the comments to a
+// worksheet as xlsx marshals it. The elements go where the schema of the
+// worksheet wants them: data validations before printOptions, the legacy
+// drawing of the comments last.
+func templateSheetXML(sheet string, columns []templateColumn) string {
+	var dv []string
+	for i, c := range columns {
+		var formula string
+		switch {
+		case c.designations:
+			formula = fmt.Sprintf("%s!$A$2:$A$%d", designationSheetName, templateRows)
+		case len(c.list) != 0:
+			formula = `"` + strings.Join(c.list, ",") + `"`
+		default:
+			continue
+		}
+		ref := fmt.Sprintf("%s2:%s%d", columnName(i), columnName(i), templateRows)
+		dv = append(dv, fmt.Sprintf(`<dataValidation type="list" allowBlank="1" showErrorMessage="1" sqref="%s"><formula1>%s</formula1></dataValidation>`,
+			ref, html.EscapeString(formula)))
+	}
+	if len(dv) != 0 {
+		sheet = strings.Replace(sheet, "<printOptions", fmt.Sprintf(`<dataValidations count="%d">%s</dataValidations><printOptions`, len(dv), strings.Join(dv, "")), 1)
+	}
+	sheet = strings.Replace(sheet, `<selection pane="topLeft"`, `<selection pane="bottomLeft"`, 1)
+	sheet = strings.Replace(sheet, `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`,
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">`, 1)
+	return strings.Replace(sheet, "</worksheet>", `<legacyDrawing r:id="rId2"/></worksheet>`, 1)
+}
+
+// templateComments are the column descriptions as comments on the header
+// cells.
+func templateComments(columns []templateColumn) string {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<comments xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><authors><author>firestoreUpload</author></authors><commentList>`)
+	for i, c := range columns {
+		desc := c.desc
+		if isDateColumn(c.name) {
+			desc += " A date, mm-dd-yy."
+		}
+		fmt.Fprintf(&b, `<comment ref="%s1" authorId="0"><text><r><t xml:space="preserve">%s</t></r></text></comment>`,
+			columnName(i), html.EscapeString(desc))
+	}
+	b.WriteString(`</commentList></comments>`)
+	return b.String()
+}
+
+// templateCommentShapes are the boxes Excel shows the comments in. Every
+// sheet needs its own range of shape IDs, 1024 per sheet.
+func templateCommentShapes(columns []templateColumn, sheet int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<xml xmlns:v="urn:schemas-microsoft-com:vml" xmlns:o="urn:schemas-microsoft-com:office:office" xmlns:x="urn:schemas-microsoft-com:office:excel">`+
+		`<o:shapelayout v:ext="edit"><o:idmap v:ext="edit" data="%d"/></o:shapelayout>`+
+		`<v:shapetype id="_x0000_t202" coordsize="21600,21600" o:spt="202" path="m,l,21600r21600,l21600,xe">`+
+		`<v:stroke joinstyle="miter"/><v:path gradientshapeok="t" o:connecttype="rect"/></v:shapetype>`, sheet)
+	for i := range columns {
+		fmt.Fprintf(&b, `<v:shape id="_x0000_s%d" type="#_x0000_t202" style="position:absolute;margin-left:80pt;margin-top:2pt;width:160pt;height:60pt;z-index:%d;visibility:hidden" fillcolor="#ffffe1" o:insetmode="auto">`+
+			`<v:fill color2="#ffffe1"/><v:shadow on="t" color="black" obscured="t"/><v:path o:connecttype="none"/>`+
+			`<v:textbox style="mso-direction-alt:auto"><div style="text-align:left"></div></v:textbox>`+
+			`<x:ClientData ObjectType="Note"><x:MoveWithCells/><x:SizeWithCells/><x:Anchor>%d, 15, 0, 2, %d, 15, 4, 16</x:Anchor>`+
+			`<x:AutoFill>False</x:AutoFill><x:Row>0</x:Row><x:Column>%d</x:Column></x:ClientData></v:shape>`,
+			sheet*1024+i+1, i+1, i+1, i+3, i)
+	}
+	b.WriteString(`</xml>`)
+	return b.String()
+}
+
+// columnName returns the letters of the zero based column i.
+func columnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// writeParts zips the parts of a workbook, the content types first.
+func writeParts(path string, parts map[string]string) error {
+	names := make([]string, 0, len(parts))
+	for name := range parts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if (names[i] == "[Content_Types].xml") != (names[j] == "[Content_Types].xml") {
+			return names[i] == "[Content_Types].xml"
+		}
+		return names[i] < names[j]
+	})
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(f)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err == nil {
+			_, err = io.WriteString(w, parts[name])
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// validationIssue is a problem in the source workbook found before anything
+// is written to Firestore. Warnings are reported but don't stop the upload.
+type validationIssue struct {
+	sheet   string
+	row     int
+	key     string
+	msg     string
+	warning bool
+}
+
+func (v validationIssue) String() string {
+	where := v.sheet
+	if v.row > 0 {
+		where += fmt.Sprintf(" row %d", v.row)
+	}
+	if v.key == "" {
+		return fmt.Sprintf("%s: %s", where, v.msg)
+	}
+	return fmt.Sprintf("%s %q: %s", where, v.key, v.msg)
+}
+
+// MarshalJSON gives an issue the fields of its log line, for the API of the
+// serve command.
+func (v validationIssue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Sheet   string `json:"sheet"`
+		Row     int    `json:"row,omitempty"`
+		Key     string `json:"key,omitempty"`
+		Msg     string `json:"msg"`
+		Warning bool   `json:"warning"`
+	}{v.sheet, v.row, v.key, v.msg, v.warning})
+}
+
+// rowKey holds the sheet row number of a line, counting the header as row 1.
+// Header names don't start with "#", so it can't clash with a column.
+const rowKey = "#row"
+
+// rowOf returns the sheet row of a line, or 0 when it isn't known.
+func rowOf(line map[string]string) int {
+	row, _ := strconv.Atoi(line[rowKey])
+	return row
+}
+
+// splitIssues separates the blocking errors from the warnings.
+func splitIssues(issues []validationIssue) (errs, warnings []validationIssue) {
+	for _, issue := range issues {
+		if issue.warning {
+			warnings = append(warnings, issue)
+		} else {
+			errs = append(errs, issue)
+		}
+	}
+	return errs, warnings
+}
+
+// sourceData is the parsed content of a source workbook together with
+// everything derived from it and the problems found on the way.
+type sourceData struct {
+	path string
+	// imageURLsOnly is set for sources from other machines, see
+	// sourceOptions.
+	imageURLsOnly bool
+
+	userlines            []map[string]string
+	projectlines         []map[string]string
+	measurementlines     []map[string]string
+	designationlines     []map[string]string
+	measurementrefslines []map[string]string
+	contactlines         []map[string]string
+	calibrationlines     []map[string]string
+
+	cables       []cable
+	designations []designation
+	expected     map[string]expectedElongation
+	curves       map[string]*calibrationCurve
+	curveOrder   []string
+
+	issues []validationIssue
+}
+
+// sourceOptions are the settings of loadSource.
+type sourceOptions struct {
+	// calibrations is a separate xlsx or CSV file with the calibration
+	// table, instead of the one of the source.
+	calibrations string
+	certPeriod   time.Duration
+	reader       readerOptions
+	// imageURLsOnly rejects local files in the image columns. A source
+	// posted from another machine could otherwise name any file of this
+	// one to be uploaded.
+	imageURLsOnly bool
+}
+
+// loadSource reads the source and the calibration table and validates them.
+// Only unreadable files are returned as errors, problems in the data end up
+// in issues.
+func loadSource(path string, opts sourceOptions) (src *sourceData, err error) {
+	reader, err := openSourceReader(path, opts.reader)
+	if err != nil {
+		return nil, err
+	}
+	sheets, err := reader.read(path)
+	if err != nil {
+		return nil, err
+	}
+	src = &sourceData{
+		path:                 path,
+		imageURLsOnly:        opts.imageURLsOnly,
+		userlines:            sheets.users,
+		projectlines:         sheets.project,
+		measurementlines:     sheets.measurements,
+		designationlines:     sheets.designations,
+		measurementrefslines: sheets.refs,
+		contactlines:         sheets.contacts,
+		calibrationlines:     sheets.calibration,
+	}
+
+	if opts.calibrations != "" {
+		src.calibrationlines, err = readCalibrationFile(opts.calibrations, opts.reader)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading calibrations from %q: %v", opts.calibrations, err)
+		}
+	}
+
+	src.validate(opts.certPeriod, time.Now())
+	return src, nil
+}
+
+func (src *sourceData) validate(certPeriod time.Duration, now time.Time) {
+	var issues []validationIssue
+	src.cables, issues = groupCables(src.measurementlines)
+	src.issues = append(src.issues, issues...)
+	src.designations, issues = buildDesignations(src.designationlines)
+	src.issues = append(src.issues, issues...)
+	src.expected, issues = designationElongations(src.designationlines, src.cables)
+	src.issues = append(src.issues, issues...)
+	src.curves, src.curveOrder, issues = buildCalibrations(src.calibrationlines)
+	src.issues = append(src.issues, issues...)
+	src.issues = append(src.issues, checkCalibrations(src.projectlines, src.curves, certPeriod, now)...)
+	src.issues = append(src.issues, checkStatuses(src.projectlines)...)
+	src.issues = append(src.issues, checkIntegrity(src)...)
+	if src.imageURLsOnly {
+		src.issues = append(src.issues, checkImageURLs(src.projectlines)...)
+	} else {
+		src.issues = append(src.issues, checkImages(src.projectlines, src.dir())...)
+	}
+	src.issues = append(src.issues, checkMarkers(src)...)
+}
+
+// dir is the directory relative file references of the source are resolved
+// in: the directory of a source file, or the source directory itself.
+func (src *sourceData) dir() string {
+	if info, err := os.Stat(src.path); err == nil && info.IsDir() {
+		return src.path
+	}
+	return filepath.Dir(src.path)
+}
+
+// sourceFlags are the command line flags of the commands that read a source.
+type sourceFlags struct {
+	certDays     *int
+	calibrations *string
+	delimiter    *string
+	encoding     *string
+	imageURLs    *bool
+}
+
+func addSourceFlags(fs *flag.FlagSet) *sourceFlags {
+	return &sourceFlags{
+		certDays:     fs.Int("cert-days", 365, "warn when a project's calibration_date is older than this many days, 0 disables the check"),
+		calibrations: fs.String("calibrations", "", "xlsx or CSV file with ram calibration certificates (default: Calibration sheet of the source)"),
+		delimiter:    fs.String("delimiter", ",", "field delimiter of CSV sources, a single character or \"tab\""),
+		encoding:     fs.String("encoding", "utf-8", "text encoding of CSV sources: utf-8 (with or without BOM) or windows-1252"),
+		imageURLs:    fs.Bool("image-urls-only", false, "reject local files in the image columns, only URLs and storage paths (always on for serve)"),
+	}
+}
+
+// options turns the parsed flags into the settings of loadSource.
+func (sf *sourceFlags) options() (sourceOptions, error) {
+	delimiter, err := parseDelimiter(*sf.delimiter)
+	if err != nil {
+		return sourceOptions{}, err
+	}
+	return sourceOptions{
+		calibrations:  *sf.calibrations,
+		certPeriod:    time.Duration(*sf.certDays) * 24 * time.Hour,
+		reader:        readerOptions{delimiter: delimiter, encoding: *sf.encoding},
+		imageURLsOnly: *sf.imageURLs,
+	}, nil
+}
+
+// args gives the flags back as command line arguments, for a command run as
+// a child process with the same settings.
+func (sf *sourceFlags) args() []string {
+	args := []string{"-cert-days", strconv.Itoa(*sf.certDays), "-calibrations", *sf.calibrations,
+		"-delimiter", *sf.delimiter, "-encoding", *sf.encoding}
+	if *sf.imageURLs {
+		args = append(args, "-image-urls-only")
+	}
+	return args
+}
+
+// load reads the source named by the first argument of fs, or the default
+// upload_sheet.xlsx. The source is an xlsx workbook or a directory of CSV
+// files.
+func (sf *sourceFlags) load(fs *flag.FlagSet) *sourceData {
+	path := "upload_sheet.xlsx"
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+	applog.info("Reading source", "path", path)
+
+	opts, err := sf.options()
+	if err != nil {
+		applog.fatal(err.Error())
+	}
+	src, err := loadSource(path, opts)
+	if err != nil {
+		applog.fatal("Can't read source", "path", path, "err", err)
+	}
+	return src
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// The folders of the watched directory that take the files the watcher is
+// done with, each next to its report.
+const (
+	processedDir = "processed"
+	failedDir    = "failed"
+)
+
+// watchedFile is the size and modification time of a file of the watched
+// directory and since when they are unchanged.
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// watcher polls a directory for workbooks and uploads every one that stopped
+// changing for settle, so files still being copied or saved are left alone.
+// The uploads run as the upload command, like those of serve.
+type watcher struct {
+	dir        string
+	settle     time.Duration
+	client     *firestore.Client
+	uploadArgs []string
+	files      map[string]*watchedFile
+}
+
+func runWatch(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	lf := addLogFlags(fs)
+	pf := addProfileFlags(fs, true)
+	sf := addSourceFlags(fs)
+	interval := fs.Duration("interval", 5*time.Second, "how often the directory is checked")
+	settle := fs.Duration("settle", 10*time.Second, "how long a workbook must stay unchanged before it is uploaded")
+	history := fs.Bool("history", false, "run the uploads with -history")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: firestoreUpload watch [flags] <directory>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	lf.apply()
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if _, err := sf.options(); err != nil {
+		applog.fatal(err.Error())
+	}
+	pf.load()
+	pf.confirm("WATCH UPLOADS TO")
+	dir := fs.Arg(0)
+	for _, sub := range []string{processedDir, failedDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			applog.fatal("Can't create folder", "dir", filepath.Join(dir, sub), "err", err)
+		}
+	}
+
+	ctx := rootContext(0, true)
+	client, err := openFirestore(ctx, openApp(ctx))
+	if err != nil {
+		applog.fatal("Can't open Firestore", "err", err)
+	}
+	atExit(func() { client.Close() })
+
+	w := &watcher{dir: dir, settle: *settle, client: client, uploadArgs: append(pf.args(), sf.args()...),
+		files: make(map[string]*watchedFile)}
+	if *history {
+		w.uploadArgs = append(w.uploadArgs, "-history")
+	}
+	applog.info("Watching", "dir", dir, "interval", *interval, "settle", *settle)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		w.poll(ctx)
+		select {
+		case <-ticker.C:
+		case <-interrupted:
+			applog.info("Stopped watching")
+			return
+		}
+	}
+}
+
+// poll looks at the workbooks of the directory and processes the ones that
+// are ready. Excel's lock files (~$name.xlsx) and hidden files are skipped.
+func (w *watcher) poll(ctx context.Context) {
+	infos, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		applog.error("Can't read the watched directory", "dir", w.dir, "err", err)
+		return
+	}
+	now := time.Now()
+	seen := make(map[string]bool)
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || strings.ToLower(filepath.Ext(name)) != ".xlsx" ||
+			strings.HasPrefix(name, "~$") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		seen[name] = true
+		f, ok := w.files[name]
+		if !ok || f.size != info.Size() || !f.modTime.Equal(info.ModTime()) {
+			w.files[name] = &watchedFile{size: info.Size(), modTime: info.ModTime(), since: now}
+			continue
+		}
+		if now.Sub(f.since) < w.settle || isInterrupted() {
+			continue
+		}
+		w.process(ctx, name)
+		delete(w.files, name)
+	}
+	for name := range w.files {
+		if !seen[name] {
+			delete(w.files, name)
+		}
+	}
+}
+
+// process uploads a workbook and moves it to processed or failed. A workbook
+// with the hash of one that was uploaded completely before isn't uploaded
+// again. A workbook whose upload was interrupted stays, so it is uploaded
+// again on the next start.
+func (w *watcher) process(ctx context.Context, name string) {
+	path := filepath.Join(w.dir, name)
+	log := applog.with("file", name)
+	sum, err := fileSHA256(path)
+	if err != nil {
+		log.error("Can't read workbook", "err", err)
+		return
+	}
+	report := fmt.Sprintf("Source:  %s\nSHA-256: %s\nTime:    %s\n", name, sum, time.Now().Format(time.RFC3339))
+
+	runID, err := uploadedRun(ctx, w.client, sum)
+	if err != nil {
+		log.error("Can't look up earlier uploads", "err", err)
+		return
+	}
+	if runID != "" {
+		log.warn("Workbook was uploaded before, skipping it", "run", runID)
+		w.finish(name, processedDir, report+"Result:  skipped, the same workbook was uploaded by run "+runID+"\n")
+		return
+	}
+
+	log.info("Uploading workbook", "sha256", sum)
+	code, out, err := runChildUpload(path, w.uploadArgs)
+	if err != nil {
+		log.error("Can't run the upload", "err", err)
+		return
+	}
+	switch code {
+	case 0:
+		log.info("Workbook uploaded")
+		w.finish(name, processedDir, report+"Result:  uploaded\n\n"+string(out))
+	case exitInterrupted:
+		log.warn("Upload interrupted, the workbook stays to be uploaded again")
+	default:
+		log.error("Upload failed, see the report", "exit_code", code)
+		w.finish(name, failedDir, report+fmt.Sprintf("Result:  failed with exit code %d\n\n", code)+string(out))
+	}
+}
+
+// finish moves a workbook into a folder of the watched directory and writes
+// its report next to it. Both names start with the time, so a workbook
+// dropped again doesn't replace the earlier one.
+func (w *watcher) finish(name, folder, report string) {
+	dest := filepath.Join(w.dir, folder, time.Now().UTC().Format("20060102T150405Z")+"_"+name)
+	if err := os.Rename(filepath.Join(w.dir, name), dest); err != nil {
+		applog.error("Can't move workbook", "file", name, "to", dest, "err", err)
+		return
+	}
+	if err := ioutil.WriteFile(dest+".report.txt", []byte(report), 0644); err != nil {
+		applog.error("Can't write report", "path", dest+".report.txt", "err", err)
+		return
+	}
+	applog.info("Moved workbook", "file", name, "to", dest)
+}